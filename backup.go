@@ -0,0 +1,402 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const backupManifest = "backup.json"
+const backupDatabase = "main.db"
+
+type backupInfo struct {
+	Version    int    `json:"version"`
+	Time       string `json:"time"`
+	Workspaces bool   `json:"workspaces"`
+}
+
+// The schema version the upgrade scripts bring a database to.
+func schemaVersion() int {
+	version := 1
+	for {
+		if _, err := os.Stat(fmt.Sprintf("%s/upgrade-%d.sql", schemaPath, version)); err != nil {
+			return version
+		}
+		version += 1
+	}
+}
+
+// Copies the live database to filename with the SQLite online backup API.
+func backupDatabaseTo(filename string) error {
+	dst, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	ctx := context.Background()
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+	srcConn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	return dstConn.Raw(func(dc interface{}) error {
+		return srcConn.Raw(func(sc interface{}) error {
+			b, err := dc.(*sqlite3.SQLiteConn).Backup("main", sc.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			_, err = b.Step(-1)
+			if err != nil {
+				b.Finish()
+				return err
+			}
+			return b.Finish()
+		})
+	})
+}
+
+func tarFile(tw *tar.Writer, name, filename string, info os.FileInfo) error {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, _ = os.Readlink(filename)
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	err = tw.WriteHeader(header)
+	if err != nil || !info.Mode().IsRegular() {
+		return err
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// Writes a gzipped tar of the database and the project directories. Workspaces are only included when asked for,
+// the per build environment and digest files are always left out.
+func writeBackup(w io.Writer, workspaces bool) error {
+	temp, err := ioutil.TempFile(uploadAbs, "backup-")
+	if err != nil {
+		return err
+	}
+	temp.Close()
+	defer os.Remove(temp.Name())
+	err = backupDatabaseTo(temp.Name())
+	if err != nil {
+		return err
+	}
+	var version int
+	check, err := sql.Open("sqlite3", temp.Name())
+	if err != nil {
+		return err
+	}
+	err = check.QueryRow(`SELECT value FROM config WHERE name = 'version'`).Scan(&version)
+	check.Close()
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	manifest, _ := json.MarshalIndent(backupInfo{version, time.Now().UTC().Format(time.RFC3339), workspaces}, "", "  ")
+	tw.WriteHeader(&tar.Header{Name: backupManifest, Mode: 0644, Size: int64(len(manifest)), ModTime: time.Now()})
+	tw.Write(manifest)
+	info, err := os.Stat(temp.Name())
+	if err != nil {
+		return err
+	}
+	err = tarFile(tw, backupDatabase, temp.Name(), info)
+	if err != nil {
+		return err
+	}
+	err = filepath.Walk(projectAbs, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(projectAbs, path)
+		if rel == "." {
+			return nil
+		}
+		parts := strings.Split(rel, string(filepath.Separator))
+		if len(parts) == 2 && parts[1] == "workspace" && info.IsDir() && !workspaces {
+			return tarFile(tw, "projects/"+filepath.ToSlash(rel), path, info)
+		}
+		if len(parts) > 2 && parts[1] == "workspace" && !workspaces {
+			return filepath.SkipDir
+		}
+		if len(parts) == 2 && (parts[1] == "environment" || parts[1] == "digest") {
+			return nil
+		}
+		return tarFile(tw, "projects/"+filepath.ToSlash(rel), path, info)
+	})
+	if err != nil {
+		return err
+	}
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func handleServerBackup(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/server/backup", params) {
+		return
+	}
+	workspaces, _ := strconv.ParseBool(params["workspaces"])
+	name := fmt.Sprintf("racs-%s.tar.gz", time.Now().UTC().Format("20060102-150405"))
+	// Written to a temporary file first, so a failure can still be answered with an error instead of a truncated archive
+	f, err := ioutil.TempFile(filepath.Dir(projectAbs), "backup-")
+	if err == nil {
+		defer os.Remove(f.Name())
+		defer f.Close()
+		err = writeBackup(f, workspaces)
+	}
+	var size int64
+	if err == nil {
+		size, err = f.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		logger.Errorf("Backup failed: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Add("Content-Type", "application/gzip")
+	w.Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Header().Add("Content-Length", strconv.FormatInt(size, 10))
+	io.Copy(w, f)
+	logger.Infof("Backup %s written", name)
+}
+
+func backupCommand(args []string) int {
+	workspaces := false
+	output := ""
+	for _, arg := range args {
+		if arg == "-workspaces" {
+			workspaces = true
+		} else {
+			output = arg
+		}
+	}
+	if output == "" {
+		fmt.Fprintln(os.Stderr, "Usage: racs [-config file] backup [-workspaces] file")
+		return 2
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	err = writeBackup(f, workspaces)
+	f.Close()
+	if err != nil {
+		os.Remove(output)
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// Extracts the archive into dir, returning the manifest. Entries are written with extractEntry, like uploaded archives,
+// so nothing in a backup can write or link outside of dir.
+func extractBackup(filename, dir string) (*backupInfo, error) {
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	var info *backupInfo
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := filepath.Clean("/" + header.Name)
+		if name != "/"+backupManifest && name != "/"+backupDatabase && !strings.HasPrefix(name, "/projects/") {
+			return nil, fmt.Errorf("Unexpected file %s in backup", header.Name)
+		}
+		if header.Typeflag == tar.TypeLink {
+			return nil, fmt.Errorf("%s is a hard link, which isn't supported", header.Name)
+		}
+		err = extractEntry(dir, name[1:], header.FileInfo().Mode(), header.Linkname, tr, func(string) error {
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if name == "/"+backupManifest {
+			info = &backupInfo{}
+			bytes, _ := ioutil.ReadFile(filepath.Join(dir, backupManifest))
+			err = json.Unmarshal(bytes, info)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if info == nil {
+		return nil, errors.New("Backup has no manifest")
+	}
+	return info, nil
+}
+
+func validateRestore(dir string, info *backupInfo) error {
+	check, err := sql.Open("sqlite3", filepath.Join(dir, backupDatabase))
+	if err != nil {
+		return err
+	}
+	defer check.Close()
+	var integrity string
+	err = check.QueryRow(`PRAGMA integrity_check`).Scan(&integrity)
+	if err != nil {
+		return err
+	}
+	if integrity != "ok" {
+		return fmt.Errorf("Backup database integrity check failed: %s", integrity)
+	}
+	var version int
+	err = check.QueryRow(`SELECT value FROM config WHERE name = 'version'`).Scan(&version)
+	if err != nil {
+		return err
+	}
+	if version != info.Version {
+		return fmt.Errorf("Backup database version %d does not match manifest version %d", version, info.Version)
+	}
+	if current := schemaVersion(); version > current {
+		return fmt.Errorf("Backup schema version %d is newer than this racs (%d)", version, current)
+	}
+	return nil
+}
+
+// Copies the restored database next to the current one, so that it can be renamed into place.
+func stageDatabase(from, database string) (string, error) {
+	in, err := os.Open(from)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := ioutil.TempFile(filepath.Dir(database), "restore-")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// Restores a backup in place of the database and projects directory. The current ones are kept with a .pre-restore suffix.
+// The backup is extracted next to the projects directory and the database copied next to the current one, so each of
+// them is put in place with a rename on its own file system.
+func restoreCommand(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: racs [-config file] restore file")
+		return 2
+	}
+	lock, err := lockDatabase()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer lock.Close()
+	database, _ := filepath.Abs(cfg.Paths.Database)
+	dir, err := ioutil.TempDir(filepath.Dir(projectAbs), "restore-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	info, err := extractBackup(args[0], dir)
+	if err == nil {
+		err = validateRestore(dir, info)
+	}
+	staged := ""
+	if err == nil {
+		staged, err = stageDatabase(filepath.Join(dir, backupDatabase), database)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.Remove(staged)
+	os.MkdirAll(filepath.Join(dir, "projects"), 0777)
+	suffix := ".pre-restore-" + time.Now().UTC().Format("20060102-150405")
+	type move struct{ from, to string }
+	done := make([]move, 0)
+	for _, m := range []move{
+		{database, database + suffix},
+		{projectAbs, projectAbs + suffix},
+		{staged, database},
+		{filepath.Join(dir, "projects"), projectAbs},
+	} {
+		err := os.Rename(m.from, m.to)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			// Put back whatever was already moved, newest first
+			for i := len(done) - 1; i >= 0; i-- {
+				if err := os.Rename(done[i].to, done[i].from); err != nil {
+					fmt.Fprintf(os.Stderr, "Could not move %s back to %s: %v\n", done[i].to, done[i].from, err)
+				}
+			}
+			return 1
+		}
+		done = append(done, m)
+	}
+	fmt.Printf("Restored backup from %s, schema version %d\n", info.Time, info.Version)
+	fmt.Printf("Previous database and projects kept with suffix %s\n", suffix)
+	if !info.Workspaces {
+		fmt.Println("Workspaces were not included, build projects from clone to restore them")
+	}
+	return 0
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The build hash is the sha256 of the build spec, of the context directory and of the upstream image the build
+// image is made from, one after the other. Any of them changing means the build image has to be prepared again.
+var buildHashParts = []string{"build spec", "context directory", "upstream image"}
+
+func projectBuildHash(p *project) []byte {
+	spec := sha256.New()
+	f, err := os.Open(fmt.Sprintf("%s/%d/%s", projectAbs, p.id, p.buildSpec))
+	if err == nil {
+		io.Copy(spec, f)
+		f.Close()
+	} else {
+		logger.Warn(err)
+	}
+
+	// Names, types and contents in walk order, which is lexical, so the hash doesn't depend on the file system.
+	context := sha256.New()
+	root := fmt.Sprintf("%s/%d/context", projectAbs, p.id)
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			fmt.Fprintf(context, "error %s\x00", err)
+			return nil
+		}
+		rel := strings.TrimPrefix(path, root)
+		switch {
+		case info.IsDir():
+			fmt.Fprintf(context, "dir %s %o\x00", rel, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, _ := os.Readlink(path)
+			fmt.Fprintf(context, "link %s %s\x00", rel, link)
+		case info.Mode().IsRegular():
+			fmt.Fprintf(context, "file %s %o %d\x00", rel, info.Mode().Perm(), info.Size())
+			f, err := os.Open(path)
+			if err == nil {
+				io.Copy(context, f)
+				f.Close()
+			}
+		}
+		return nil
+	})
+
+	upstream := sha256.New()
+	if p.prepareDep != nil {
+		out, err := exec.Command("podman", "image", "inspect", "--format", "{{.Id}}", fmt.Sprintf("package-%d", p.prepareDep.id)).Output()
+		if err != nil {
+			logger.Warnf("Project %d upstream image: %v", p.id, err)
+		}
+		upstream.Write(bytes.TrimSpace(out))
+	}
+
+	result := spec.Sum(nil)
+	result = context.Sum(result)
+	return upstream.Sum(result)
+}
+
+// Describes why the build image needs preparing again, or returns an empty string if it doesn't.
+func buildHashReason(previous, current []byte) string {
+	if bytes.Equal(previous, current) {
+		return ""
+	}
+	if len(previous) != len(current) {
+		return "no previous build hash of the spec, context and upstream image"
+	}
+	changed := make([]string, 0)
+	for i, part := range buildHashParts {
+		if !bytes.Equal(previous[i*sha256.Size:(i+1)*sha256.Size], current[i*sha256.Size:(i+1)*sha256.Size]) {
+			changed = append(changed, part)
+		}
+	}
+	return fmt.Sprintf("%s changed", strings.Join(changed, ", "))
+}
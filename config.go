@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+type config struct {
+	Port         int    `toml:"port"`
+	SSLCert      string `toml:"ssl_cert"`
+	SSLKey       string `toml:"ssl_key"`
+	NoLogin      bool   `toml:"no_login"`
+	MinFreeSpace int64  `toml:"min_free_space"`
+	Paths        struct {
+		Projects string `toml:"projects"`
+		Tasks    string `toml:"tasks"`
+		Uploads  string `toml:"uploads"`
+		Database string `toml:"database"`
+		Static   string `toml:"static"`
+		Schemas  string `toml:"schemas"`
+		Certs    string `toml:"certs"`
+	} `toml:"paths"`
+	Prune struct {
+		Interval duration `toml:"interval"`
+		Until    duration `toml:"until"`
+	} `toml:"prune"`
+	Build struct {
+		Network string `toml:"network"`
+	} `toml:"build"`
+	Shutdown struct {
+		Grace duration `toml:"grace"`
+	} `toml:"shutdown"`
+	Images struct {
+		Keep int `toml:"keep"`
+	} `toml:"images"`
+	Usage struct {
+		Interval duration `toml:"interval"`
+	} `toml:"usage"`
+
+	// Keys in the file that don't match any setting, reported by check.
+	undecoded []string
+}
+
+func defaultConfig() *config {
+	c := &config{}
+	c.Port = 8080
+	c.MinFreeSpace = 1024
+	c.Paths.Projects = "projects"
+	c.Paths.Tasks = "tasks"
+	c.Paths.Uploads = "uploads"
+	c.Paths.Database = "main.db"
+	c.Paths.Static = "static"
+	c.Paths.Schemas = "schemas"
+	c.Paths.Certs = "certs"
+	c.Prune.Interval = duration{time.Minute}
+	c.Prune.Until = duration{5 * time.Minute}
+	c.Build.Network = "host"
+	c.Shutdown.Grace = duration{5 * time.Minute}
+	c.Images.Keep = 5
+	c.Usage.Interval = duration{15 * time.Minute}
+	return c
+}
+
+var cfg = defaultConfig()
+
+// Every setting can be overridden with RACS_<SECTION>_<NAME>, e.g. RACS_PATHS_PROJECTS.
+func configEnvironment(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := prefix + "_" + strings.ToUpper(field.Tag.Get("toml"))
+		value := v.Field(i)
+		if field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(duration{}) {
+			err := configEnvironment(value, name)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		var err error
+		switch value.Kind() {
+		case reflect.String:
+			value.SetString(env)
+		case reflect.Bool:
+			var b bool
+			b, err = strconv.ParseBool(env)
+			value.SetBool(b)
+		case reflect.Int, reflect.Int64:
+			var n int64
+			n, err = strconv.ParseInt(env, 10, 64)
+			value.SetInt(n)
+		case reflect.Struct:
+			err = value.Addr().Interface().(*duration).UnmarshalText([]byte(env))
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func loadConfig(filename string) (*config, error) {
+	c := defaultConfig()
+	if filename != "" {
+		md, err := toml.DecodeFile(filename, c)
+		if err != nil && !(errors.Is(err, os.ErrNotExist) && filename == defaultConfigFile) {
+			return nil, err
+		}
+		for _, key := range md.Undecoded() {
+			c.undecoded = append(c.undecoded, key.String())
+		}
+	}
+	err := configEnvironment(reflect.ValueOf(c).Elem(), "RACS")
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *config) check() []error {
+	errs := make([]error, 0)
+	for _, key := range c.undecoded {
+		errs = append(errs, fmt.Errorf("%s: unknown setting", key))
+	}
+	if c.Port <= 0 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port: invalid port %d", c.Port))
+	}
+	if (c.SSLCert == "") != (c.SSLKey == "") {
+		errs = append(errs, errors.New("ssl_cert and ssl_key must be set together"))
+	}
+	for _, file := range []string{c.SSLCert, c.SSLKey} {
+		if file != "" {
+			if _, err := os.Stat(file); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	for _, dir := range []string{c.Paths.Static, c.Paths.Schemas} {
+		if info, err := os.Stat(dir); err != nil {
+			errs = append(errs, err)
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("%s: not a directory", dir))
+		}
+	}
+	for name, path := range map[string]string{
+		"paths.projects": c.Paths.Projects,
+		"paths.tasks":    c.Paths.Tasks,
+		"paths.uploads":  c.Paths.Uploads,
+		"paths.database": c.Paths.Database,
+		"paths.certs":    c.Paths.Certs,
+	} {
+		if path == "" {
+			errs = append(errs, fmt.Errorf("%s: must not be empty", name))
+		}
+	}
+	if c.Prune.Interval.Duration <= 0 {
+		errs = append(errs, errors.New("prune.interval: must be positive"))
+	}
+	if c.Prune.Until.Duration <= 0 {
+		errs = append(errs, errors.New("prune.until: must be positive"))
+	}
+	if c.Shutdown.Grace.Duration < 0 {
+		errs = append(errs, errors.New("shutdown.grace: must not be negative"))
+	}
+	if c.Usage.Interval.Duration <= 0 {
+		errs = append(errs, errors.New("usage.interval: must be positive"))
+	}
+	if c.Images.Keep < 1 {
+		errs = append(errs, errors.New("images.keep: must be at least 1"))
+	}
+	if c.Build.Network == "" {
+		errs = append(errs, errors.New("build.network: must not be empty"))
+	}
+	return errs
+}
+
+const defaultConfigFile = "racs.toml"
+
+var projectAbs, taskAbs, uploadAbs, certAbs, staticPath, schemaPath string
+
+func applyConfig(c *config) {
+	cfg = c
+	noLogin = c.NoLogin
+	minFreeSpace = c.MinFreeSpace
+	projectAbs, _ = filepath.Abs(c.Paths.Projects)
+	taskAbs, _ = filepath.Abs(c.Paths.Tasks)
+	uploadAbs, _ = filepath.Abs(c.Paths.Uploads)
+	certAbs, _ = filepath.Abs(c.Paths.Certs)
+	staticPath, _ = filepath.Abs(c.Paths.Static)
+	schemaPath, _ = filepath.Abs(c.Paths.Schemas)
+}
+
+func configCheck(filename string) int {
+	c, err := loadConfig(filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	errs := c.check()
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	toml.NewEncoder(os.Stdout).Encode(c)
+	return 0
+}
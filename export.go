@@ -0,0 +1,594 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type exportDestination struct {
+	Registry string `json:"registry" yaml:"registry"`
+	Tag      string `json:"tag" yaml:"tag"`
+}
+
+type exportTrigger struct {
+	Project   string            `json:"project" yaml:"project"`
+	Stage     string            `json:"stage" yaml:"stage"`
+	On        string            `json:"on,omitempty" yaml:"on,omitempty"`
+	Branches  string            `json:"branches,omitempty" yaml:"branches,omitempty"`
+	Tags      string            `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Labels    string            `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Variables map[string]string `json:"variables,omitempty" yaml:"variables,omitempty"`
+}
+
+type exportBinding struct {
+	Name       string `json:"name" yaml:"name"`
+	Credential string `json:"credential" yaml:"credential"`
+}
+
+type exportSchedule struct {
+	Spec    string `json:"spec" yaml:"spec"`
+	Stage   string `json:"stage" yaml:"stage"`
+	Enabled bool   `json:"enabled" yaml:"enabled"`
+}
+
+type exportJoin struct {
+	Upstreams []string `json:"upstreams" yaml:"upstreams"`
+	Window    string   `json:"window" yaml:"window"`
+	Stage     string   `json:"stage" yaml:"stage"`
+}
+
+type exportProject struct {
+	Name           string              `json:"name" yaml:"name"`
+	URL            string              `json:"url" yaml:"url"`
+	Branch         string              `json:"branch" yaml:"branch"`
+	Labels         string              `json:"labels,omitempty" yaml:"labels,omitempty"`
+	BuildSpec      string              `json:"buildSpec" yaml:"buildSpec"`
+	PrepackageSpec string              `json:"prepackageSpec,omitempty" yaml:"prepackageSpec,omitempty"`
+	PackageSpec    string              `json:"packageSpec" yaml:"packageSpec"`
+	Protected      bool                `json:"protected,omitempty" yaml:"protected,omitempty"`
+	TagRepo        bool                `json:"tagRepo,omitempty" yaml:"tagRepo,omitempty"`
+	Versioning     string              `json:"versioning,omitempty" yaml:"versioning,omitempty"`
+	VersionFile    string              `json:"versionFile,omitempty" yaml:"versionFile,omitempty"`
+	GitTagFormat   string              `json:"gitTagFormat,omitempty" yaml:"gitTagFormat,omitempty"`
+	PollInterval   string              `json:"pollInterval,omitempty" yaml:"pollInterval,omitempty"`
+	Quota          int64               `json:"quota,omitempty" yaml:"quota,omitempty"`
+	Specs          map[string]string   `json:"specs,omitempty" yaml:"specs,omitempty"`
+	Destinations   []exportDestination `json:"destinations,omitempty" yaml:"destinations,omitempty"`
+	Triggers       []exportTrigger     `json:"triggers,omitempty" yaml:"triggers,omitempty"`
+	Environment    []exportBinding     `json:"environment,omitempty" yaml:"environment,omitempty"`
+	Schedules      []exportSchedule    `json:"schedules,omitempty" yaml:"schedules,omitempty"`
+	Join           *exportJoin         `json:"join,omitempty" yaml:"join,omitempty"`
+}
+
+type exportFile struct {
+	Projects []exportProject `json:"projects" yaml:"projects"`
+}
+
+func stageName(s state) string {
+	for name, stage := range stageNames {
+		if stage == s {
+			return name
+		}
+	}
+	return "none"
+}
+
+// Spec files under the workspace come from the git repository and are not exported.
+func exportedSpec(path string) bool {
+	path = filepath.Clean("/" + path)
+	return path != "/" && !strings.HasPrefix(path, "/workspace/")
+}
+
+func exportProjects() (*exportFile, error) {
+	ids := make([]int, 0)
+	names := make(map[string]bool)
+	snapshot := snapshotProjects()
+	for id, p := range snapshot {
+		if names[p.name] {
+			return nil, fmt.Errorf("Project name %q is not unique", p.name)
+		}
+		names[p.name] = true
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	f := &exportFile{make([]exportProject, 0)}
+	for _, id := range ids {
+		p := snapshot[id]
+		e := exportProject{
+			Name:           p.name,
+			URL:            p.url,
+			Branch:         p.branch,
+			Labels:         p.labels,
+			BuildSpec:      p.buildSpec,
+			PrepackageSpec: p.prepackageSpec,
+			PackageSpec:    p.packageSpec,
+			Protected:      p.protected,
+			TagRepo:        p.tagRepo,
+			Versioning:     p.versioning,
+			VersionFile:    p.versionFile,
+			GitTagFormat:   p.gitTagFormat,
+			Quota:          p.quota,
+			Specs:          make(map[string]string),
+		}
+		if p.pollInterval > 0 {
+			e.PollInterval = (time.Duration(p.pollInterval) * time.Second).String()
+		}
+		for _, spec := range []string{p.buildSpec, p.prepackageSpec, p.packageSpec} {
+			if spec == "" || !exportedSpec(spec) {
+				continue
+			}
+			bytes, err := ioutil.ReadFile(fmt.Sprintf("%s/%d/%s", projectAbs, p.id, spec))
+			if err == nil {
+				e.Specs[spec] = string(bytes)
+			}
+		}
+		for _, destination := range p.destinations {
+			e.Destinations = append(e.Destinations, exportDestination{destination.registry.name, destination.tag})
+		}
+		for _, t := range p.triggers {
+			e.Triggers = append(e.Triggers, exportTrigger{t.project.name, stageName(t.state), t.on, t.branches, t.tags, t.labels, t.variables})
+		}
+		bindings := make([]string, 0)
+		for name := range p.credentials {
+			bindings = append(bindings, name)
+		}
+		sort.Strings(bindings)
+		for _, name := range bindings {
+			e.Environment = append(e.Environment, exportBinding{name, p.credentials[name].description})
+		}
+		scheduleMutex.Lock()
+		for _, s := range schedules {
+			if s.project == p {
+				e.Schedules = append(e.Schedules, exportSchedule{s.spec, stageName(s.stage), s.enabled})
+			}
+		}
+		scheduleMutex.Unlock()
+		sort.Slice(e.Schedules, func(i, j int) bool {
+			return e.Schedules[i].Spec < e.Schedules[j].Spec
+		})
+		if p.join != nil {
+			j := &exportJoin{make([]string, 0), p.join.window.String(), stageName(p.join.stage)}
+			for _, u := range p.join.upstreams {
+				j.Upstreams = append(j.Upstreams, u.name)
+			}
+			e.Join = j
+		}
+		f.Projects = append(f.Projects, e)
+	}
+	return f, nil
+}
+
+func encodeExport(f *exportFile, format string) ([]byte, error) {
+	if format == "json" {
+		return json.MarshalIndent(f, "", "  ")
+	}
+	var sb strings.Builder
+	encoder := yaml.NewEncoder(&sb)
+	encoder.SetIndent(2)
+	err := encoder.Encode(f)
+	return []byte(sb.String()), err
+}
+
+// Decodes YAML or JSON, which is read as YAML too. Unknown keys are rejected so that misspelt settings aren't dropped.
+func decodeExport(data []byte) (*exportFile, error) {
+	f := &exportFile{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(f)
+	if err == io.EOF {
+		err = nil
+	}
+	return f, err
+}
+
+func projectByName(name string) *project {
+	var found *project
+	for _, p := range snapshotProjects() {
+		if p.name == name && (found == nil || p.id < found.id) {
+			found = p
+		}
+	}
+	return found
+}
+
+func registryByName(name string) *registry {
+	for _, r := range registries {
+		if r.name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+func credentialByDescription(description string) *credential {
+	for _, cr := range credentials {
+		if cr.description == description {
+			return cr
+		}
+	}
+	return nil
+}
+
+func validateImport(f *exportFile) []error {
+	errs := make([]error, 0)
+	names := make(map[string]bool)
+	for _, e := range f.Projects {
+		if e.Name == "" {
+			errs = append(errs, errors.New("Project without a name"))
+		} else if names[e.Name] {
+			errs = append(errs, fmt.Errorf("Project %q is listed more than once", e.Name))
+		}
+		names[e.Name] = true
+	}
+	known := func(name string) bool {
+		return names[name] || projectByName(name) != nil
+	}
+	for _, e := range f.Projects {
+		if e.Versioning != "" && !versionSchemes[e.Versioning] {
+			errs = append(errs, fmt.Errorf("%s: invalid versioning %q", e.Name, e.Versioning))
+		}
+		if _, err := parsePollInterval(e.PollInterval); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", e.Name, err))
+		}
+		if e.Quota < 0 {
+			errs = append(errs, fmt.Errorf("%s: invalid quota %d", e.Name, e.Quota))
+		}
+		for path := range e.Specs {
+			if !exportedSpec(path) {
+				errs = append(errs, fmt.Errorf("%s: invalid spec path %q", e.Name, path))
+			}
+		}
+		for _, d := range e.Destinations {
+			if registryByName(d.Registry) == nil {
+				errs = append(errs, fmt.Errorf("%s: registry %q not found", e.Name, d.Registry))
+			}
+		}
+		for _, t := range e.Triggers {
+			if !known(t.Project) {
+				errs = append(errs, fmt.Errorf("%s: trigger project %q not found", e.Name, t.Project))
+			}
+			if _, err := (triggerSpec{0, t.Stage, t.On, t.Branches, t.Tags, t.Labels, t.Variables}).triggerTo(nil); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", e.Name, err))
+			}
+		}
+		for _, b := range e.Environment {
+			if credentialByDescription(b.Credential) == nil {
+				errs = append(errs, fmt.Errorf("%s: credential %q not found", e.Name, b.Credential))
+			}
+		}
+		for _, s := range e.Schedules {
+			if _, err := parseCron(s.Spec); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", e.Name, err))
+			}
+			if _, ok := stageNames[s.Stage]; !ok {
+				errs = append(errs, fmt.Errorf("%s: invalid schedule stage %q", e.Name, s.Stage))
+			}
+		}
+		if e.Join != nil {
+			for _, name := range e.Join.Upstreams {
+				if !known(name) || name == e.Name {
+					errs = append(errs, fmt.Errorf("%s: invalid join upstream %q", e.Name, name))
+				}
+			}
+			if window, err := time.ParseDuration(e.Join.Window); err != nil || window <= 0 {
+				errs = append(errs, fmt.Errorf("%s: invalid join window %q", e.Name, e.Join.Window))
+			}
+			if _, ok := stageNames[e.Join.Stage]; !ok {
+				errs = append(errs, fmt.Errorf("%s: invalid join stage %q", e.Name, e.Join.Stage))
+			}
+		}
+	}
+	if len(errs) == 0 {
+		if err := importCycle(f); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Looks for trigger cycles in the graph as it would be after the import. Projects are matched by name, the ones still
+// to be created get negative IDs.
+func importCycle(f *exportFile) error {
+	ids := make(map[string]int)
+	names := make(map[int]string)
+	for _, p := range snapshotProjects() {
+		names[p.id] = p.name
+	}
+	listed := make(map[*project]bool)
+	for i, e := range f.Projects {
+		if p := projectByName(e.Name); p != nil {
+			ids[e.Name] = p.id
+			listed[p] = true
+		} else {
+			ids[e.Name] = -1 - i
+			names[-1-i] = e.Name
+		}
+	}
+	id := func(name string) int {
+		if id, ok := ids[name]; ok {
+			return id
+		}
+		return projectByName(name).id
+	}
+	edges := make(map[int][]int)
+	for _, q := range snapshotProjects() {
+		if listed[q] {
+			continue
+		}
+		for _, t := range q.triggers {
+			edges[q.id] = append(edges[q.id], t.project.id)
+		}
+		if q.join != nil {
+			for _, u := range q.join.upstreams {
+				edges[u.id] = append(edges[u.id], q.id)
+			}
+		}
+	}
+	for _, e := range f.Projects {
+		for _, t := range e.Triggers {
+			edges[ids[e.Name]] = append(edges[ids[e.Name]], id(t.Project))
+		}
+		if e.Join != nil {
+			for _, name := range e.Join.Upstreams {
+				edges[id(name)] = append(edges[id(name)], ids[e.Name])
+			}
+		}
+	}
+	for _, e := range f.Projects {
+		if cycle := findCycle(edges, ids[e.Name]); cycle != nil {
+			path := make([]string, 0, len(cycle))
+			for _, id := range cycle {
+				path = append(path, names[id])
+			}
+			return fmt.Errorf("Trigger cycle %s", strings.Join(path, " -> "))
+		}
+	}
+	return nil
+}
+
+// Creates or updates the projects in the file, matched by name. Projects not in the file are left alone.
+func importProjects(f *exportFile) ([]string, []error) {
+	errs := validateImport(f)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	log := make([]string, 0)
+	imported := make(map[string]*project)
+	for _, e := range f.Projects {
+		p := projectByName(e.Name)
+		if p == nil {
+			p = projectCreate(e.Name, e.URL, e.Branch, e.Labels)
+			log = append(log, fmt.Sprintf("Created project %d %s", p.id, p.name))
+		} else {
+			log = append(log, fmt.Sprintf("Updated project %d %s", p.id, p.name))
+		}
+		imported[e.Name] = p
+		p.url = e.URL
+		p.branch = e.Branch
+		p.labels = e.Labels
+		p.buildSpec = cleanSpec(e.BuildSpec)
+		p.prepackageSpec = cleanSpec(e.PrepackageSpec)
+		p.packageSpec = cleanSpec(e.PackageSpec)
+		p.protected = e.Protected
+		p.tagRepo = e.TagRepo
+		if e.Versioning != "" {
+			p.versioning = e.Versioning
+		}
+		if e.VersionFile != "" {
+			p.versionFile = filepath.Clean(e.VersionFile)
+		}
+		if e.GitTagFormat != "" {
+			p.gitTagFormat = e.GitTagFormat
+		}
+		p.pollInterval, _ = parsePollInterval(e.PollInterval)
+		p.quota = e.Quota
+		projectSave(p)
+		for path, content := range e.Specs {
+			filename := filepath.Join(fmt.Sprintf("%s/%d", projectAbs, p.id), filepath.Clean("/"+path))
+			os.MkdirAll(filepath.Dir(filename), 0777)
+			err := ioutil.WriteFile(filename, []byte(content), 0666)
+			if err == nil {
+				_, err = projectRecordRevision(p, path, []byte(content), "import")
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", e.Name, err))
+			}
+		}
+	}
+	lookup := func(name string) *project {
+		if p := imported[name]; p != nil {
+			return p
+		}
+		return projectByName(name)
+	}
+	triggers := make(map[*project][]trigger)
+	joins := make(map[*project]*fanIn)
+	for _, e := range f.Projects {
+		p := imported[e.Name]
+		triggers[p] = make([]trigger, 0)
+		for _, t := range e.Triggers {
+			tr, _ := triggerSpec{0, t.Stage, t.On, t.Branches, t.Tags, t.Labels, t.Variables}.triggerTo(lookup(t.Project))
+			triggers[p] = append(triggers[p], tr)
+		}
+		if e.Join != nil {
+			upstreams := make([]*project, 0)
+			for _, name := range e.Join.Upstreams {
+				upstreams = append(upstreams, lookup(name))
+			}
+			window, _ := time.ParseDuration(e.Join.Window)
+			joins[p] = newFanIn(upstreams, window, stageNames[e.Join.Stage])
+		} else {
+			joins[p] = nil
+		}
+	}
+	for _, e := range f.Projects {
+		p := imported[e.Name]
+		destinations := make([]destination, 0)
+		for _, d := range e.Destinations {
+			destinations = append(destinations, destination{registryByName(d.Registry), d.Tag})
+		}
+		projectSetDestinations(p, destinations)
+		projectSetTriggers(p, triggers[p])
+		environment := make(map[string]*credential)
+		for _, b := range e.Environment {
+			environment[b.Name] = credentialByDescription(b.Credential)
+		}
+		projectSetEnvironment(p, environment)
+		scheduleDeleteProject(p)
+		for _, s := range e.Schedules {
+			c, _ := parseCron(s.Spec)
+			scheduleCreate(p, s.Spec, c, stageNames[s.Stage], s.Enabled)
+		}
+		projectSetJoin(p, joins[p])
+		projectUpdateEvent(p)
+	}
+	return log, errs
+}
+
+func handleProjectExport(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/export", params) {
+		return
+	}
+	f, err := exportProjects()
+	if err != nil {
+		w.WriteHeader(409)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	data, err := encodeExport(f, params["format"])
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if params["format"] == "json" {
+		w.Header().Add("Content-Type", "application/json")
+	} else {
+		w.Header().Add("Content-Type", "application/yaml")
+	}
+	w.Write(data)
+}
+
+func handleProjectImport(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/import", params) {
+		return
+	}
+	data := []byte(params["config"])
+	if r.MultipartForm != nil && len(r.MultipartForm.File["file"]) > 0 {
+		rd, err := r.MultipartForm.File["file"][0].Open()
+		if err == nil {
+			data, err = ioutil.ReadAll(rd)
+			rd.Close()
+		}
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+	f, err := decodeExport(data)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	log, errs := importProjects(f)
+	for _, line := range log {
+		logger.Info(line)
+	}
+	if len(errs) > 0 {
+		messages := make([]string, 0)
+		for _, err := range errs {
+			messages = append(messages, err.Error())
+		}
+		w.WriteHeader(400)
+		w.Write([]byte(strings.Join(append(log, messages...), "\n")))
+		return
+	}
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte(strings.Join(append(log, "OK"), "\n")))
+	}
+}
+
+func exportCommand(args []string) int {
+	format := "yaml"
+	output := ""
+	for _, arg := range args {
+		if arg == "-json" {
+			format = "json"
+		} else {
+			output = arg
+		}
+	}
+	f, err := exportProjects()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	data, err := encodeExport(f, format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if output == "" || output == "-" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	err = ioutil.WriteFile(output, data, 0666)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func importCommand(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: racs [-config file] import file")
+		return 2
+	}
+	var data []byte
+	var err error
+	if args[0] == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(args[0])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	f, err := decodeExport(data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	log, errs := importProjects(f)
+	for _, line := range log {
+		fmt.Println(line)
+	}
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func within(root, path string) bool {
+	return path == root || strings.HasPrefix(path, root+"/")
+}
+
+// Walks down rel from root one component at a time, creating missing directories and following symlinks only
+// while they stay inside root. MkdirAll would happily create directories through a symlink pointing elsewhere.
+func extractDir(root, rel string) (string, error) {
+	dir := root
+	for _, part := range strings.Split(rel, "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		next := filepath.Join(dir, part)
+		info, err := os.Lstat(next)
+		switch {
+		case os.IsNotExist(err):
+			err = os.Mkdir(next, 0777)
+		case err != nil:
+		case info.Mode()&os.ModeSymlink != 0:
+			next, err = filepath.EvalSymlinks(next)
+			if err == nil && !within(root, next) {
+				err = fmt.Errorf("%s leads outside of the directory", rel)
+			}
+		case !info.IsDir():
+			err = fmt.Errorf("%s is not a directory", filepath.Join(dir, part)[len(root):])
+		}
+		if err != nil {
+			return "", err
+		}
+		dir = next
+	}
+	return dir, nil
+}
+
+// Symlinks may only go up with leading ".." components, a ".." after a name could climb out of wherever a symlink
+// in the name leads.
+func safeLink(link string) bool {
+	if filepath.IsAbs(link) {
+		return false
+	}
+	climbing := true
+	for _, part := range strings.Split(link, "/") {
+		if part == ".." {
+			if !climbing {
+				return false
+			}
+		} else if part != "." && part != "" {
+			climbing = false
+		}
+	}
+	return true
+}
+
+// Extracts a single archive entry below root, which must have no symlinks in it. Every path written to, after
+// resolving symlinks, is passed to check first.
+func extractEntry(root, name string, mode os.FileMode, link string, r io.Reader, check func(string) error) error {
+	name = filepath.Clean(name)
+	if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return fmt.Errorf("%s is outside of the directory", name)
+	}
+	if name == "." {
+		return nil
+	}
+	if mode.IsDir() {
+		dir, err := extractDir(root, name)
+		if err == nil {
+			err = check(dir)
+		}
+		return err
+	}
+	dir, err := extractDir(root, filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(dir, filepath.Base(name))
+	if err := check(target); err != nil {
+		return err
+	}
+	if info, err := os.Lstat(target); err == nil {
+		if info.IsDir() {
+			return fmt.Errorf("%s is a directory", name)
+		}
+		if !info.Mode().IsRegular() || mode&os.ModeSymlink != 0 {
+			os.Remove(target)
+		}
+	}
+	switch {
+	case mode&os.ModeSymlink != 0:
+		if !safeLink(link) || !within(root, filepath.Join(dir, link)) {
+			return fmt.Errorf("%s links outside of the directory", name)
+		}
+		if err := check(filepath.Join(dir, link)); err != nil {
+			return err
+		}
+		return os.Symlink(link, target)
+	case mode.IsRegular():
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm()|0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, r)
+		f.Close()
+		return err
+	}
+	return fmt.Errorf("%s is not a file, directory or symlink", name)
+}
+
+func extractZip(filename, root string, check func(string) error) error {
+	z, err := zip.OpenReader(filename)
+	if err != nil {
+		return err
+	}
+	defer z.Close()
+	for _, file := range z.File {
+		r, err := file.Open()
+		if err != nil {
+			return err
+		}
+		link := ""
+		if file.Mode()&os.ModeSymlink != 0 {
+			target, _ := ioutil.ReadAll(r)
+			link = string(target)
+		}
+		err = extractEntry(root, file.Name, file.Mode(), link, r, check)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractTar(r io.Reader, root string, check func(string) error) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		mode := header.FileInfo().Mode()
+		if header.Typeflag == tar.TypeLink {
+			return fmt.Errorf("%s is a hard link, which isn't supported", header.Name)
+		}
+		err = extractEntry(root, header.Name, mode, header.Linkname, tr, check)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Extracts a zip or a tar archive, optionally compressed with gzip or bzip2, into root.
+func extractArchive(filename, root string, check func(string) error) error {
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK")):
+		return extractZip(filename, root, check)
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		return extractTar(gz, root, check)
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return extractTar(bzip2.NewReader(br), root, check)
+	}
+	return extractTar(br, root, check)
+}
+
+// Extracts an uploaded archive to a directory in the project. When replacing, the archive is extracted next to the
+// directory first and exchanged with it once it is complete, so builds never see a partly extracted or missing directory.
+func projectExtract(p *project, upload, name string, replace bool) error {
+	path := filepath.Clean("/" + name)
+	if projectFileHidden(path) || (replace && path == "/") {
+		return fmt.Errorf("Can't extract to %s", path)
+	}
+	projectRoot, err := filepath.EvalSymlinks(fmt.Sprintf("%s/%d", projectAbs, p.id))
+	if err != nil {
+		return err
+	}
+	// Nothing may be written to the paths the files API hides, e.g. the workspace when extracting to /.
+	check := func(filename string) error {
+		if rel := strings.TrimPrefix(filename, projectRoot); projectFileHidden(rel) {
+			return fmt.Errorf("Can't extract to %s", rel)
+		}
+		return nil
+	}
+	if !replace {
+		root, err := extractDir(projectRoot, path)
+		if err == nil {
+			err = extractArchive(upload, root, check)
+		}
+		return err
+	}
+	parent, err := extractDir(projectRoot, filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	temp, err := ioutil.TempDir(parent, ".extract-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(temp)
+	os.Chmod(temp, 0777)
+	err = extractArchive(upload, temp, check)
+	if err != nil {
+		return err
+	}
+	// The previous contents end up in temp and are removed with it
+	return replaceDir(temp, filepath.Join(parent, filepath.Base(path)))
+}
+
+// Moves temp to target with two renames, putting whatever was at target in temp. target is missing in between, so
+// this is only used where the file system can't exchange them in one step.
+func renameDirs(temp, target string) error {
+	old := temp + ".old"
+	err := os.Rename(target, old)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Rename(temp, target)
+	if err != nil {
+		os.Rename(old, target)
+		return err
+	}
+	if os.Rename(old, temp) != nil {
+		return os.RemoveAll(old)
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Exchanges temp and target in one step, so target is never missing. Falls back to renameDirs when target doesn't
+// exist yet or the file system doesn't support exchanging.
+func replaceDir(temp, target string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, temp, unix.AT_FDCWD, target, unix.RENAME_EXCHANGE)
+	if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOSYS) {
+		if _, statErr := os.Lstat(temp); statErr == nil {
+			return renameDirs(temp, target)
+		}
+	}
+	return err
+}
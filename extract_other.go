@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// Without renameat2 the directory is replaced with two renames, and is briefly missing in between.
+func replaceDir(temp, target string) error {
+	return renameDirs(temp, target)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Whether a path in the project directory is hidden from the files API. The workspace is managed by the build and
+// the environment file holds credential values.
+func projectFileHidden(path string) bool {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	switch parts[0] {
+	case "workspace":
+		return true
+	case "environment", "digest":
+		return len(parts) == 1
+	}
+	return false
+}
+
+// Resolves a path given to the files API to a file in the project directory, refusing anything outside of it.
+func projectFile(p *project, name string) (string, string, error) {
+	path := filepath.Clean("/" + name)
+	root, err := filepath.EvalSymlinks(fmt.Sprintf("%s/%d", projectAbs, p.id))
+	if err != nil {
+		return "", "", err
+	}
+	if projectFileHidden(path) {
+		return "", "", errors.New("Not found")
+	}
+	filename, err := filepath.EvalSymlinks(root + path)
+	if err != nil {
+		return "", "", errors.New("Not found")
+	}
+	if filename != root && !strings.HasPrefix(filename, root+"/") {
+		return "", "", errors.New("Not found")
+	}
+	if projectFileHidden(strings.TrimPrefix(filename, root)) {
+		return "", "", errors.New("Not found")
+	}
+	return path, filename, nil
+}
+
+func handleProjectFiles(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/files", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := findProject(id)
+	if p == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Project not found"))
+		return
+	}
+	path, filename, err := projectFile(p, params["path"])
+	if err != nil {
+		w.WriteHeader(404)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	result := make([]map[string]interface{}, 0)
+	filepath.Walk(filename, func(name string, info os.FileInfo, err error) error {
+		if err != nil || name == filename {
+			return nil
+		}
+		rel := filepath.Join(path, strings.TrimPrefix(name, filename))
+		if projectFileHidden(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		result = append(result, map[string]interface{}{
+			"path":    rel,
+			"size":    info.Size(),
+			"time":    info.ModTime().UTC().Format("2006-01-02 15:04:05"),
+			"dir":     info.IsDir(),
+			"symlink": info.Mode()&os.ModeSymlink != 0,
+			"spec":    rel == revisionPath(p.buildSpec) || rel == revisionPath(p.prepackageSpec) || rel == revisionPath(p.packageSpec),
+		})
+		return nil
+	})
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
+
+func handleProjectFilesDownload(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/files/download", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := findProject(id)
+	if p == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Project not found"))
+		return
+	}
+	path, filename, err := projectFile(p, params["path"])
+	if err != nil {
+		w.WriteHeader(404)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Not found"))
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		w.WriteHeader(400)
+		w.Write([]byte("Not a file"))
+		return
+	}
+	w.Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+	http.ServeContent(w, r, filepath.Base(path), info.ModTime(), f)
+}
+
+func handleProjectFilesDelete(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/files/delete", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := findProject(id)
+	if p == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Project not found"))
+		return
+	}
+	path, _, err := projectFile(p, params["path"])
+	if err != nil {
+		w.WriteHeader(404)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if path == "/" || path == "/context" {
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("%s can't be deleted", path)))
+		return
+	}
+	// Remove the entry itself, a symlink is deleted rather than what it points to.
+	err = os.RemoveAll(fmt.Sprintf("%s/%d%s", projectAbs, p.id, path))
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	logger.Infof("Project %d deleted %s", p.id, path)
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
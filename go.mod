@@ -3,9 +3,12 @@ module racs
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/mattn/go-sqlite3 v1.14.17
 	github.com/msteinert/pam v1.1.0
 	github.com/smartystreets/goconvey v1.8.1 // indirect
 	github.com/withmandala/go-log v0.1.0
 	golang.org/x/crypto v0.11.0 // indirect
+	golang.org/x/sys v0.10.0
+	gopkg.in/yaml.v3 v3.0.1
 )
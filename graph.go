@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Returns the trigger edges of all projects, with the triggers of p replaced by the given triggers.
+func triggerEdges(p *project, triggers []trigger) map[int][]int {
+	return triggerEdgesWith(map[*project][]trigger{p: triggers})
+}
+
+func triggerEdgesWith(replace map[*project][]trigger) map[int][]int {
+	edges := make(map[int][]int)
+	for id, q := range snapshotProjects() {
+		ts, ok := replace[q]
+		if !ok {
+			ts = q.triggers
+		}
+		for _, t := range ts {
+			edges[id] = append(edges[id], t.project.id)
+		}
+		if q.join != nil {
+			for _, u := range q.join.upstreams {
+				edges[u.id] = append(edges[u.id], id)
+			}
+		}
+	}
+	return edges
+}
+
+// Returns a path of project IDs from start back to start, or nil if start is not part of a cycle.
+func findCycle(edges map[int][]int, start int) []int {
+	visited := make(map[int]bool)
+	var visit func(id int, path []int) []int
+	visit = func(id int, path []int) []int {
+		for _, next := range edges[id] {
+			if next == start {
+				return append(path, next)
+			}
+			if visited[next] {
+				continue
+			}
+			visited[next] = true
+			if cycle := visit(next, append(path, next)); cycle != nil {
+				return cycle
+			}
+		}
+		return nil
+	}
+	return visit(start, []int{start})
+}
+
+func formatCycle(cycle []int) string {
+	names := make([]string, 0, len(cycle))
+	for _, id := range cycle {
+		names = append(names, fmt.Sprintf("#%d", id))
+	}
+	return strings.Join(names, " -> ")
+}
+
+type graphEdge struct {
+	From  int    `json:"from"`
+	To    int    `json:"to"`
+	Type  string `json:"type"`
+	State string `json:"state,omitempty"`
+}
+
+func projectGraph() ([]map[string]interface{}, []graphEdge) {
+	nodes := make([]map[string]interface{}, 0)
+	edges := make([]graphEdge, 0)
+	for id, p := range snapshotProjects() {
+		nodes = append(nodes, map[string]interface{}{
+			"id":      id,
+			"name":    p.name,
+			"state":   p.state.String(),
+			"version": p.version,
+		})
+		for _, t := range p.triggers {
+			edges = append(edges, graphEdge{id, t.project.id, "trigger", t.state.String()})
+		}
+		if p.join != nil {
+			for _, u := range p.join.upstreams {
+				edges = append(edges, graphEdge{u.id, id, "join", p.join.stage.String()})
+			}
+		}
+		for _, dep := range []struct {
+			project *project
+			kind    string
+		}{
+			{p.prepareDep, "prepare"},
+			{p.prepackageDep, "prepackage"},
+			{p.packageDep, "package"},
+		} {
+			if dep.project != nil {
+				edges = append(edges, graphEdge{dep.project.id, id, dep.kind, ""})
+			}
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i]["id"].(int) < nodes[j]["id"].(int)
+	})
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].From != edges[j].From {
+			return edges[i].From < edges[j].From
+		}
+		if edges[i].To != edges[j].To {
+			return edges[i].To < edges[j].To
+		}
+		return edges[i].Type > edges[j].Type
+	})
+	return nodes, edges
+}
+
+func handleProjectGraph(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	nodes, edges := projectGraph()
+	if params["format"] == "dot" {
+		var sb strings.Builder
+		sb.WriteString("digraph racs {\n")
+		for _, node := range nodes {
+			fmt.Fprintf(&sb, "\tp%d [label=%q];\n", node["id"], fmt.Sprintf("#%d %s", node["id"], node["name"]))
+		}
+		for _, edge := range edges {
+			if edge.Type == "trigger" {
+				fmt.Fprintf(&sb, "\tp%d -> p%d [label=%q];\n", edge.From, edge.To, edge.State)
+			} else if edge.Type == "join" {
+				fmt.Fprintf(&sb, "\tp%d -> p%d [label=%q, style=bold];\n", edge.From, edge.To, "join "+edge.State)
+			} else {
+				fmt.Fprintf(&sb, "\tp%d -> p%d [label=%q, style=dashed];\n", edge.From, edge.To, "--from "+edge.Type)
+			}
+		}
+		sb.WriteString("}\n")
+		w.Header().Add("Content-Type", "text/vnd.graphviz")
+		w.Write([]byte(sb.String()))
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(map[string]interface{}{
+		"nodes": nodes,
+		"edges": edges,
+	})
+	w.Write(j)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+var minFreeSpace int64
+
+func checkCommand(name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v %s", name, err, out)
+	}
+	return nil
+}
+
+func checkDatabase() error {
+	_, err := db.Exec(`UPDATE config SET value = value WHERE name = 'version'`)
+	return err
+}
+
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, "readyz-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func checkFreeSpace(dir string) error {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(dir, &stat)
+	if err != nil {
+		return err
+	}
+	free := int64(stat.Bavail) * int64(stat.Bsize) / (1024 * 1024)
+	if free < minFreeSpace {
+		return fmt.Errorf("%dMB free, %dMB required", free, minFreeSpace)
+	}
+	return nil
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	w.WriteHeader(200)
+	w.Write([]byte("OK"))
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	checks := []struct {
+		name  string
+		check func() error
+	}{
+		{"drain", func() error {
+			if isDraining() {
+				return errors.New("draining")
+			}
+			return nil
+		}},
+		{"db", checkDatabase},
+		{"podman", func() error { return checkCommand("podman", "version") }},
+		{"git", func() error { return checkCommand("git", "--version") }},
+		{"projects", func() error { return checkWritable(projectAbs) }},
+		{"tasks", func() error { return checkWritable(taskAbs) }},
+		{"uploads", func() error { return checkWritable(uploadAbs) }},
+		{"disk", func() error { return checkFreeSpace(projectAbs) }},
+	}
+	status := 200
+	result := make(map[string]interface{})
+	for _, c := range checks {
+		err := c.check()
+		if err != nil {
+			logger.Warnf("Readiness check %s failed: %v", c.name, err)
+			result[c.name] = err.Error()
+			status = 503
+		} else {
+			result[c.name] = "OK"
+		}
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
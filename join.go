@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A fan-in trigger, the project is built once every upstream has pushed a new version within the window.
+type fanIn struct {
+	upstreams []*project
+	window    time.Duration
+	stage     state
+	arrivals  map[int]*taskTrigger
+	times     map[int]time.Time
+}
+
+var fanInMutex sync.Mutex
+
+func newFanIn(upstreams []*project, window time.Duration, stage state) *fanIn {
+	return &fanIn{upstreams, window, stage, make(map[int]*taskTrigger), make(map[int]time.Time)}
+}
+
+func fanInJSON(j *fanIn) map[string]interface{} {
+	if j == nil {
+		return nil
+	}
+	fanInMutex.Lock()
+	defer fanInMutex.Unlock()
+	upstreams := make([]int, 0)
+	pending := make([]int, 0)
+	for _, u := range j.upstreams {
+		upstreams = append(upstreams, u.id)
+		if _, ok := j.arrivals[u.id]; ok {
+			pending = append(pending, u.id)
+		}
+	}
+	return map[string]interface{}{
+		"upstreams": upstreams,
+		"window":    int(j.window / time.Second),
+		"stage":     j.stage.String(),
+		"arrived":   pending,
+	}
+}
+
+func loadFanIns(states map[string]state) {
+	rows, err := db.Query(`SELECT project, upstreams, within, stage FROM joins`)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pid int
+		var upstreamList string
+		var window int
+		var stage string
+		rows.Scan(&pid, &upstreamList, &window, &stage)
+		p := findProject(pid)
+		if p == nil {
+			continue
+		}
+		upstreams := make([]*project, 0)
+		for _, id := range strings.Split(upstreamList, ",") {
+			uid, _ := strconv.Atoi(id)
+			if u := findProject(uid); u != nil {
+				upstreams = append(upstreams, u)
+			}
+		}
+		if len(upstreams) > 0 {
+			p.join = newFanIn(upstreams, time.Duration(window)*time.Second, states[stage])
+		}
+	}
+}
+
+// Records a new version of upstream p for every join waiting on it, and builds the joined projects that are complete.
+func fanInArrive(p *project, trigger *taskTrigger) {
+	now := time.Now()
+	for _, target := range snapshotProjects() {
+		j := target.join
+		if j == nil {
+			continue
+		}
+		fanInMutex.Lock()
+		waiting := false
+		for _, u := range j.upstreams {
+			if u == p {
+				waiting = true
+			}
+		}
+		if !waiting {
+			fanInMutex.Unlock()
+			continue
+		}
+		j.arrivals[p.id] = trigger
+		j.times[p.id] = now
+		upstreams := make(map[int]int)
+		for _, u := range j.upstreams {
+			if findProject(u.id) == nil {
+				continue
+			}
+			arrival, ok := j.arrivals[u.id]
+			if ok && now.Sub(j.times[u.id]) > j.window {
+				delete(j.arrivals, u.id)
+				delete(j.times, u.id)
+				ok = false
+			}
+			if !ok {
+				upstreams = nil
+				break
+			}
+			upstreams[u.id] = arrival.version
+		}
+		if len(upstreams) == 0 {
+			logger.Infof("Project %d join waiting, project %d version %d arrived", target.id, p.id, trigger.version)
+			fanInMutex.Unlock()
+			continue
+		}
+		arrivals, times := j.arrivals, j.times
+		j.arrivals = make(map[int]*taskTrigger)
+		j.times = make(map[int]time.Time)
+		fanInMutex.Unlock()
+		logger.Infof("Project %d join complete %v", target.id, upstreams)
+		joined := *trigger
+		joined.upstreams = upstreams
+		if err := target.buildFrom(j.stage, taskRequest{PUSH_SUCCESS, 0, &joined, nil}); err != nil {
+			// Keep the arrivals so the next upstream version builds the project, unless newer ones came in meanwhile
+			fanInMutex.Lock()
+			for id, arrival := range arrivals {
+				if _, ok := j.arrivals[id]; !ok {
+					j.arrivals[id] = arrival
+					j.times[id] = times[id]
+				}
+			}
+			fanInMutex.Unlock()
+		}
+	}
+}
+
+// Removes a deleted project from the joins waiting on it, and removes joins left without upstreams.
+func fanInDeleteProject(p *project) {
+	for _, target := range snapshotProjects() {
+		j := target.join
+		if j == nil || target == p {
+			continue
+		}
+		fanInMutex.Lock()
+		upstreams := make([]*project, 0)
+		for _, u := range j.upstreams {
+			if u != p {
+				upstreams = append(upstreams, u)
+			}
+		}
+		changed := len(upstreams) != len(j.upstreams)
+		j.upstreams = upstreams
+		delete(j.arrivals, p.id)
+		delete(j.times, p.id)
+		fanInMutex.Unlock()
+		if !changed {
+			continue
+		}
+		if len(upstreams) == 0 {
+			logger.Infof("Project %d join removed, its last upstream project %d was deleted", target.id, p.id)
+			projectSetJoin(target, nil)
+		} else {
+			projectSetJoin(target, j)
+		}
+		projectUpdateEvent(target)
+	}
+}
+
+func projectSetJoin(p *project, j *fanIn) {
+	p.join = j
+	if j == nil {
+		db.Exec(`DELETE FROM joins WHERE project = ?`, p.id)
+		return
+	}
+	ids := make([]string, 0)
+	for _, u := range j.upstreams {
+		ids = append(ids, strconv.Itoa(u.id))
+	}
+	db.Exec(`INSERT OR REPLACE INTO joins(project, upstreams, within, stage) VALUES(?, ?, ?, ?)`,
+		p.id, strings.Join(ids, ","), int(j.window/time.Second), j.stage.String())
+}
+
+func handleProjectJoin(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/join", params) {
+		return
+	}
+	pid, _ := strconv.Atoi(params["id"])
+	p := findProject(pid)
+	if p == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Project not found"))
+		return
+	}
+	upstreams := make([]*project, 0)
+	for _, id := range strings.FieldsFunc(params["upstreams"], func(c rune) bool {
+		return c == ','
+	}) {
+		uid, _ := strconv.Atoi(strings.TrimSpace(id))
+		upstream := findProject(uid)
+		if upstream == nil || upstream == p {
+			w.WriteHeader(400)
+			w.Write([]byte(fmt.Sprintf("Invalid upstream project %s", id)))
+			return
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	if len(upstreams) == 0 {
+		projectSetJoin(p, nil)
+	} else {
+		window, err := time.ParseDuration(params["window"])
+		if err != nil || window <= 0 {
+			w.WriteHeader(400)
+			w.Write([]byte("Invalid window"))
+			return
+		}
+		stage, ok := stageNames[params["stage"]]
+		if !ok {
+			w.WriteHeader(400)
+			w.Write([]byte("Invalid stage"))
+			return
+		}
+		j := newFanIn(upstreams, window, stage)
+		previous := p.join
+		p.join = j
+		if cycle := findCycle(triggerEdges(p, p.triggers), p.id); cycle != nil {
+			p.join = previous
+			w.WriteHeader(400)
+			w.Write([]byte(fmt.Sprintf("Trigger cycle %s", formatCycle(cycle))))
+			return
+		}
+		projectSetJoin(p, j)
+	}
+	projectUpdateEvent(p)
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Takes an exclusive lock on a file next to the database, held until the process exits. The database file itself
+// isn't locked because restoring replaces it. Fails straight away if another instance holds the lock.
+func lockDatabase() (*os.File, error) {
+	database, _ := filepath.Abs(cfg.Paths.Database)
+	f, err := os.OpenFile(database+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		f.Close()
+		return nil, fmt.Errorf("Database %s is in use by another instance", database)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
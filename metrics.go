@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type metricSeries struct {
+	labels  []string
+	value   float64
+	buckets []uint64
+	count   uint64
+}
+
+type metric struct {
+	mutex   sync.Mutex
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*metricSeries
+}
+
+var metrics = []*metric{}
+
+func newMetric(kind, name, help string, buckets []float64, labels ...string) *metric {
+	m := &metric{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*metricSeries{},
+	}
+	metrics = append(metrics, m)
+	return m
+}
+
+func newCounter(name, help string, labels ...string) *metric {
+	return newMetric("counter", name, help, nil, labels...)
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metric {
+	return newMetric("histogram", name, help, buckets, labels...)
+}
+
+func (m *metric) get(values []string) *metricSeries {
+	key := strings.Join(values, "\x00")
+	s := m.series[key]
+	if s == nil {
+		s = &metricSeries{values, 0, make([]uint64, len(m.buckets)), 0}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metric) inc(values ...string) {
+	m.mutex.Lock()
+	m.get(values).value += 1
+	m.mutex.Unlock()
+}
+
+func (m *metric) observe(v float64, values ...string) {
+	m.mutex.Lock()
+	s := m.get(values)
+	for i, bound := range m.buckets {
+		if v <= bound {
+			s.buckets[i] += 1
+		}
+	}
+	s.value += v
+	s.count += 1
+	m.mutex.Unlock()
+}
+
+// The text exposition format only escapes backslashes, double quotes and line feeds in label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabel(name, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, formatLabel(name, values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, formatLabel(extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (m *metric) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		switch m.kind {
+		case "histogram":
+			for i, bound := range m.buckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labels, "le", formatFloat(bound)), s.buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labels, "le", "+Inf"), s.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labels), formatFloat(s.value))
+			fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.labels), s.count)
+		default:
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, s.labels), formatFloat(s.value))
+		}
+	}
+}
+
+var metricTasksStarted = newCounter("racs_tasks_started_total", "Tasks started, by project and stage.", "project", "type")
+var metricTasksSucceeded = newCounter("racs_tasks_succeeded_total", "Tasks completed successfully, by project and stage.", "project", "type")
+var metricTasksFailed = newCounter("racs_tasks_failed_total", "Tasks completed with an error, by project and stage.", "project", "type")
+var metricTaskDuration = newHistogram("racs_task_duration_seconds", "Task duration in seconds, by stage.",
+	[]float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600}, "type")
+var metricRegistryLoginFailures = newCounter("racs_registry_login_failures_total", "Failed registry logins, by registry.", "registry")
+var metricImagePrunes = newCounter("racs_image_prune_runs_total", "Image prune runs, by result.", "result")
+
+var sseClients int64
+
+func taskStarted(p *project, kind string) time.Time {
+	metricTasksStarted.inc(strconv.Itoa(p.id), kind)
+	return time.Now()
+}
+
+func taskFinished(p *project, kind string, started time.Time, err error) {
+	if err != nil {
+		metricTasksFailed.inc(strconv.Itoa(p.id), kind)
+	} else {
+		metricTasksSucceeded.inc(strconv.Itoa(p.id), kind)
+	}
+	metricTaskDuration.observe(time.Since(started).Seconds(), kind)
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	w.Header().Add("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metrics {
+		m.write(w)
+	}
+	snapshot := snapshotProjects()
+	ids := make([]int, 0, len(snapshot))
+	for id := range snapshot {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	fmt.Fprintf(w, "# HELP racs_queue_depth Pending task requests, by project.\n")
+	fmt.Fprintf(w, "# TYPE racs_queue_depth gauge\n")
+	for _, id := range ids {
+		fmt.Fprintf(w, "racs_queue_depth{%s} %d\n", formatLabel("project", strconv.Itoa(id)), len(snapshot[id].queue))
+	}
+	fmt.Fprintf(w, "# HELP racs_sse_clients Connected event stream clients.\n")
+	fmt.Fprintf(w, "# TYPE racs_sse_clients gauge\n")
+	fmt.Fprintf(w, "racs_sse_clients %d\n", atomic.LoadInt64(&sseClients))
+}
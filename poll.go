@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const minPollInterval = 30 * time.Second
+const maxPollBackoff = time.Hour
+
+type pollStatus struct {
+	next     time.Time
+	failures int
+	head     string
+}
+
+var polls = map[int]*pollStatus{}
+var pollMutex sync.Mutex
+
+// Accepts a duration such as 5m or a number of seconds, 0 disables polling.
+func parsePollInterval(s string) (int, error) {
+	if s == "" || s == "0" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		n, err2 := strconv.Atoi(s)
+		if err2 != nil {
+			return 0, err
+		}
+		d = time.Duration(n) * time.Second
+	}
+	if d < minPollInterval {
+		return 0, fmt.Errorf("Poll interval must be at least %s", minPollInterval)
+	}
+	return int(d / time.Second), nil
+}
+
+func pollDelay(interval time.Duration, failures int) time.Duration {
+	delay := interval
+	for i := 0; i < failures && delay < maxPollBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxPollBackoff && interval < maxPollBackoff {
+		delay = maxPollBackoff
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay/10)+1))
+}
+
+func remoteHead(url, branch string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", "ls-remote", url, "refs/heads/"+branch)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", errors.New("Branch not found")
+	}
+	return fields[0], nil
+}
+
+func pollProject(p *project, status *pollStatus) {
+	head, err := remoteHead(p.url, p.branch)
+	pollMutex.Lock()
+	defer pollMutex.Unlock()
+	interval := time.Duration(p.pollInterval) * time.Second
+	if err != nil {
+		status.failures += 1
+		status.next = time.Now().Add(pollDelay(interval, status.failures))
+		logger.Warnf("Project %d poll of %s failed (%d), next poll %s: %v", p.id, p.url, status.failures, status.next.Format(time.RFC3339), err)
+		return
+	}
+	status.failures = 0
+	status.next = time.Now().Add(pollDelay(interval, 0))
+	if p.commit == "" || head == p.commit || head == status.head {
+		return
+	}
+	logger.Infof("Project %d branch %s moved to %s, building", p.id, p.branch, head)
+	status.head = head
+	go p.buildFrom(PULLING, defaultRequest)
+}
+
+func pollRoutine() {
+	for {
+		now := time.Now()
+		pollMutex.Lock()
+		for id, p := range snapshotProjects() {
+			status := polls[id]
+			if p.pollInterval <= 0 {
+				delete(polls, id)
+				continue
+			}
+			if status == nil {
+				status = &pollStatus{}
+				status.next = now.Add(pollDelay(time.Duration(p.pollInterval)*time.Second, 0))
+				polls[id] = status
+			}
+			if status.next.After(now) || status.next.IsZero() {
+				continue
+			}
+			// Running marker, so a slow ls-remote isn't started again
+			status.next = time.Time{}
+			go pollProject(p, status)
+		}
+		pollMutex.Unlock()
+		time.Sleep(5 * time.Second)
+	}
+}
@@ -1,11 +1,9 @@
 package main
 
 import (
-	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
@@ -23,6 +21,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"text/template"
 	"time"
 
@@ -70,10 +70,16 @@ const (
 	TAGGING              state = 28
 	TAG_ERROR            state = 29
 	TAG_SUCCESS          state = 30
+	PROMOTING            state = 31
+	PROMOTE_ERROR        state = 32
+	PROMOTE_SUCCESS      state = 33
+	TRIMMING             state = 34
+	TRIM_ERROR           state = 35
+	TRIM_SUCCESS         state = 36
 )
 
 func (s state) String() string {
-	return [34]string{
+	return [40]string{
 		"DELETING", "DELETE_ERROR", "DELETE_SUCCESS",
 		"NONE",
 		"CREATING", "CREATE_ERROR", "CREATE_SUCCESS",
@@ -86,6 +92,8 @@ func (s state) String() string {
 		"PACKAGING", "PACKAGE_ERROR", "PACKAGE_SUCCESS",
 		"PUSHING", "PUSH_ERROR", "PUSH_SUCCESS",
 		"TAGGING", "TAG_ERROR", "TAG_SUCCESS",
+		"PROMOTING", "PROMOTE_ERROR", "PROMOTE_SUCCESS",
+		"TRIMMING", "TRIM_ERROR", "TRIM_SUCCESS",
 	}[s+3]
 }
 
@@ -97,34 +105,47 @@ type task struct {
 }
 
 type registry struct {
-	id       int
-	name     string
-	url      string
-	user     string
-	password string
-	login    time.Time
-	timeout  int
+	id         int
+	name       string
+	url        string
+	credential *credential
+	auth       string
+	ca         string
+	insecure   bool
+	login      time.Time
+	timeout    int
+	failure    string
 }
 
 type taskTrigger struct {
-	url      string
-	branch   string
-	commit   string
-	tag      string
-	registry string
-	project  int
-	version  int
+	url       string
+	branch    string
+	commit    string
+	tag       string
+	registry  string
+	project   int
+	version   int
+	state     string
+	variables map[string]string
+	upstreams map[int]int
+}
+
+type promotion struct {
+	version int
+	targets []pushTarget
 }
 
 type taskRequest struct {
-	state   state
-	index   int
-	trigger *taskTrigger
+	state     state
+	index     int
+	trigger   *taskTrigger
+	promotion *promotion
 }
 
 type credential struct {
 	id          int
 	description string
+	user        string
 	value       string
 }
 
@@ -134,8 +155,13 @@ type destination struct {
 }
 
 type trigger struct {
-	project *project
-	state   state
+	project   *project
+	state     state
+	on        string
+	branches  string
+	tags      string
+	labels    string
+	variables map[string]string
 }
 
 type project struct {
@@ -161,12 +187,23 @@ type project struct {
 	prepackageDep  *project
 	packageDep     *project
 	commit         string
+	versioning     string
+	versionFile    string
+	versionBump    string
+	gitTagFormat   string
+	versionName    string
+	pollInterval   int
+	join           *fanIn
+	prepareReason  string
+	quota          int64
+	usage          *diskUsage
 }
 
 type broker struct {
 	events     chan []byte
 	register   chan chan []byte
 	unregister chan chan []byte
+	close      chan bool
 	clients    map[chan []byte]bool
 }
 
@@ -174,14 +211,16 @@ var db *sql.DB
 var registries = map[int]*registry{}
 var credentials = map[int]*credential{}
 var projects = map[int]*project{}
-var projectAbs, _ = filepath.Abs("projects")
+var projectsMutex sync.RWMutex
+var routinesStarted bool
 var clients = &broker{
 	make(chan []byte),
 	make(chan chan []byte),
 	make(chan chan []byte),
+	make(chan bool),
 	make(map[chan []byte]bool),
 }
-var defaultRequest = taskRequest{NONE, 0, nil}
+var defaultRequest = taskRequest{NONE, 0, nil, nil}
 
 func event(event map[string]interface{}) {
 	bytes, _ := json.Marshal(event)
@@ -191,39 +230,141 @@ func event(event map[string]interface{}) {
 func registryList() []map[string]interface{} {
 	result := make([]map[string]interface{}, 0)
 	for id, r := range registries {
+		credential := 0
+		if r.credential != nil {
+			credential = r.credential.id
+		}
 		result = append(result, map[string]interface{}{
-			"id":      id,
-			"name":    r.name,
-			"url":     r.url,
-			"user":    r.user,
-			"timeout": r.timeout,
+			"id":         id,
+			"name":       r.name,
+			"url":        r.url,
+			"credential": credential,
+			"auth":       r.auth,
+			"ca":         r.ca,
+			"insecure":   r.insecure,
+			"timeout":    r.timeout,
+			"failure":    r.failure,
 		})
 	}
 	return result
 }
 
-func registryCreate(name, url, user, password string, timeout int) *registry {
+func registryCreate(name, url string, cr *credential, auth, ca string, insecure bool, timeout int) *registry {
 	var id int
-	db.QueryRow(`INSERT INTO registries(name, url, user, password, timeout) VALUES(?, ?, ?, ?, ?) RETURNING id`,
-		name, url, user, password, timeout).Scan(&id)
-	logger.Infof("Registry created %s %s %s ******", name, url, user)
-	r := &registry{id, name, url, user, password, time.Unix(0, 0), timeout}
+	crid := 0
+	if cr != nil {
+		crid = cr.id
+	}
+	db.QueryRow(`INSERT INTO registries(name, url, credential, auth, ca, insecure, timeout) VALUES(?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+		name, url, crid, auth, ca, insecure, timeout).Scan(&id)
+	logger.Infof("Registry created %s %s", name, url)
+	r := &registry{id, name, url, cr, auth, ca, insecure, time.Unix(0, 0), timeout, ""}
+	registryWriteCA(r)
 	registries[r.id] = r
 	return r
 }
 
-func registryLogin(r *registry) string {
+func registryCertDir(r *registry) string {
+	return fmt.Sprintf("%s/%d", certAbs, r.id)
+}
+
+func registryWriteCA(r *registry) {
+	dir := registryCertDir(r)
+	os.RemoveAll(dir)
+	if r.ca != "" {
+		os.MkdirAll(dir, 0700)
+		err := ioutil.WriteFile(fmt.Sprintf("%s/ca.crt", dir), []byte(r.ca), 0600)
+		if err != nil {
+			logger.Error(err)
+		}
+	}
+}
+
+func registryTLSArgs(r *registry) []string {
+	args := []string{}
+	if r.insecure {
+		args = append(args, "--tls-verify=false")
+	}
+	if r.ca != "" {
+		args = append(args, "--cert-dir", registryCertDir(r))
+	}
+	return args
+}
+
+func registryUser(r *registry) string {
+	if r.credential.user == "" && r.auth == "token" {
+		return "<token>"
+	}
+	return r.credential.user
+}
+
+func registryLogin(r *registry) (string, error) {
 	if time.Since(r.login).Minutes() > float64(r.timeout) {
-		if len(r.user) > 0 {
-			exec.Command("podman", "login", r.url, "-u", r.user, "-p", r.password).Run()
+		if r.credential != nil {
+			args := append([]string{"login", "--password-stdin", "-u", registryUser(r)}, registryTLSArgs(r)...)
+			cmd := exec.Command("podman", append(args, r.url)...)
+			cmd.Stdin = strings.NewReader(r.credential.value)
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				err = fmt.Errorf("Login to registry %s failed: %v: %s", r.name, err, strings.TrimSpace(string(out)))
+				logger.Error(err)
+				metricRegistryLoginFailures.inc(r.name)
+				r.failure = err.Error()
+				event(map[string]interface{}{
+					"event":   "registry/login",
+					"id":      r.id,
+					"failure": r.failure,
+				})
+				return r.url, err
+			}
+		}
+		if r.failure != "" {
+			r.failure = ""
+			event(map[string]interface{}{
+				"event":   "registry/login",
+				"id":      r.id,
+				"failure": r.failure,
+			})
 		}
 		r.login = time.Now()
 	}
-	return r.url
+	return r.url, nil
+}
+
+func (p *project) promote(version int, destinations []destination) error {
+	if isDraining() {
+		logger.Infof("Project %d promote of version %d rejected, draining", p.id, version)
+		return errDraining
+	}
+	targets, err := pushTargets(p, version, destinations, nil)
+	if err != nil {
+		return err
+	}
+	p.queue <- taskRequest{PROMOTING, 0, nil, &promotion{version, targets}}
+	return nil
+}
+
+func (p *project) buildFrom(state state, trigger taskRequest) error {
+	if isDraining() {
+		logger.Infof("Project %d build from %s rejected, draining", p.id, state.String())
+		return errDraining
+	}
+	if err := projectCheckQuota(p, state); err != nil {
+		logger.Warnf("Project %d build from %s rejected, %v", p.id, state.String(), err)
+		return err
+	}
+	p.queue <- taskRequest{state, 0, trigger.trigger, nil}
+	return nil
 }
 
-func (p *project) buildFrom(state state, trigger taskRequest) {
-	p.queue <- taskRequest{state, 0, trigger.trigger}
+// Answers a request buildFrom refused, 503 while draining and 507 when the project is over its quota.
+func writeBuildError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errDraining) {
+		w.WriteHeader(503)
+	} else {
+		w.WriteHeader(507)
+	}
+	w.Write([]byte(err.Error()))
 }
 
 func projectEnvironment(p *project, request taskRequest) string {
@@ -239,6 +380,13 @@ func projectEnvironment(p *project, request taskRequest) string {
 		fmt.Fprintf(f, "RACS_TRIGGER_TAG=%s\n", trigger.tag)
 		fmt.Fprintf(f, "RACS_TRIGGER_PROJECT=%d\n", trigger.project)
 		fmt.Fprintf(f, "RACS_TRIGGER_REGISTRY=%s\n", trigger.registry)
+		fmt.Fprintf(f, "RACS_TRIGGER_STATE=%s\n", trigger.state)
+		for name, value := range trigger.variables {
+			fmt.Fprintf(f, "%s=%s\n", name, value)
+		}
+		for id, version := range trigger.upstreams {
+			fmt.Fprintf(f, "RACS_UPSTREAM_%d_VERSION=%d\n", id, version)
+		}
 	}
 	for name, cr := range p.credentials {
 		fmt.Fprintf(f, "%s=%s\n", name, cr.value)
@@ -256,6 +404,8 @@ func projectRoutine(p *project) {
 		logger.Infof("Project %d received task %s", p.id, state.String())
 		command := ""
 		args := []string{}
+		var failure error
+		var buildHash []byte
 		switch state {
 		case CLEANING:
 			command = "rm"
@@ -264,6 +414,8 @@ func projectRoutine(p *project) {
 			command = "git"
 			args = []string{"clone", "-v", "--recursive", "-b", p.branch, p.url, fmt.Sprintf("%s/%d/workspace/source", projectAbs, p.id)}
 		case PREPARING:
+			// Hash what the image is made from before building it, so changes made while preparing are noticed next time
+			buildHash = projectBuildHash(p)
 			command = "podman"
 			spec := fmt.Sprintf("%s/%d/%s", projectAbs, p.id, p.buildSpec)
 			args = []string{"build",
@@ -281,7 +433,7 @@ func projectRoutine(p *project) {
 			args = []string{"-C", fmt.Sprintf("%s/%d/workspace/source", projectAbs, p.id), "pull", "--recurse-submodules"}
 		case BUILDING:
 			command = "podman"
-			args = []string{"run", "--network=host", "--rm=true",
+			args = []string{"run", "--network=" + cfg.Build.Network, "--rm=true",
 				"--env-file", projectEnvironment(p, request),
 				"-v", fmt.Sprintf("%s/%d/workspace:/workspace", projectAbs, p.id),
 				"--read-only", fmt.Sprintf("builder-%d", p.id),
@@ -322,32 +474,45 @@ func projectRoutine(p *project) {
 			}
 			args = append(args, fmt.Sprintf("%s/%d/context", projectAbs, p.id))
 		case PUSHING:
-			if request.index < len(p.destinations) {
-				destination := p.destinations[request.index]
-				url := registryLogin(destination.registry)
-				tag := strings.Replace(destination.tag, "$VERSION", strconv.Itoa(p.version), -1)
+			if request.promotion == nil {
+				var targets []pushTarget
+				targets, failure = pushTargets(p, p.version, p.destinations, request.trigger)
+				request.promotion = &promotion{p.version, targets}
+			}
+			if failure != nil {
+				command = "podman"
+				args = []string{"push"}
+			} else if request.index < len(request.promotion.targets) {
+				target := request.promotion.targets[request.index]
 				command = "podman"
-				args = []string{"push", fmt.Sprintf("package-%d", p.id), fmt.Sprintf("%s/%s", url, tag)}
+				args, failure = pushArgs(p, fmt.Sprintf("package-%d", p.id), target)
 			} else {
 				command = "echo"
 				args = []string{"skipping push"}
 			}
 		case TAGGING:
 			if p.tagRepo {
-				if request.index < len(p.destinations) {
-					destination := p.destinations[request.index]
-					tag := strings.Replace(destination.tag, "$VERSION", strconv.Itoa(p.version), -1)
-					tag = tag[strings.LastIndex(tag, ":")+1:]
-					command = "git"
-					args = []string{"-C", fmt.Sprintf("%s/%d/workspace/source", projectAbs, p.id), "push", "origin", tag}
-				}
+				command = "git"
+				args = []string{"-C", fmt.Sprintf("%s/%d/workspace/source", projectAbs, p.id), "push", "origin", projectVersionInfo(p, p.version).gitTag}
 			} else {
 				command = "echo"
 				args = []string{"skipping tag"}
 			}
+		case PROMOTING:
+			target := request.promotion.targets[request.index]
+			command = "podman"
+			args, failure = pushArgs(p, fmt.Sprintf("package-%d:%d", p.id, request.promotion.version), target)
 		case DELETING:
 			command = "rm"
 			args = []string{"-vrf", fmt.Sprintf("%s/%d", projectAbs, p.id)}
+		case TRIMMING:
+			command = "find"
+			args = []string{fmt.Sprintf("%s/%d/workspace", projectAbs, p.id), "-mindepth", "1", "-maxdepth", "1", "!", "-name", "source",
+				"-exec", "rm", "-rfv", "{}", "+"}
+		}
+		if len(command) > 0 && !beginTask() {
+			logger.Infof("Project %d shutting down, dropping task %s", p.id, state.String())
+			return
 		}
 		p.state = state
 		if len(command) > 0 {
@@ -372,17 +537,28 @@ func projectRoutine(p *project) {
 				"time":    t.time,
 				"state":   "RUNNING",
 			})
-			taskRoot := fmt.Sprintf("tasks/%d", t.id)
+			taskRoot := fmt.Sprintf("%s/%d", taskAbs, t.id)
 			os.Mkdir(taskRoot, 0777)
 			logger.Infof("Task %s %v", command, args)
-			cmd := exec.Command(command, args...)
+			cmd := exec.CommandContext(taskContext, command, args...)
 			out, _ := os.Create(fmt.Sprintf("%s/out.log", taskRoot))
 			out.WriteString("\u001B[1m")
 			out.WriteString(cmd.String())
 			out.WriteString("\u001B[0m\n")
+			if state == PREPARING && p.prepareReason != "" {
+				fmt.Fprintf(out, "Preparing the build image again, %s\n", p.prepareReason)
+				p.prepareReason = ""
+			}
 			cmd.Stdout = out
 			cmd.Stderr = out
-			err = cmd.Run()
+			started := taskStarted(p, t.kind)
+			if failure != nil {
+				fmt.Fprintf(out, "%v\n", failure)
+				err = failure
+			} else {
+				err = cmd.Run()
+			}
+			taskFinished(p, t.kind, started, err)
 			if err != nil {
 				t.state = "ERROR"
 				p.state += 1
@@ -405,100 +581,238 @@ func projectRoutine(p *project) {
 				"id":      t.id,
 				"state":   t.state,
 			})
+			endTask()
 		}
 		logger.Infof("Project %d finished task %s", p.id, state.String())
 		switch p.state {
 		case CREATE_SUCCESS:
-			request = taskRequest{CLEANING, 0, request.trigger}
+			request = taskRequest{CLEANING, 0, request.trigger, nil}
 		case CLEAN_SUCCESS:
-			request = taskRequest{CLONING, 0, request.trigger}
+			projectMeasureUsage(p)
+			// Cleaning is allowed over the quota, but only continues into a build if it freed enough space
+			if err := projectCheckQuota(p, CLONING); err != nil {
+				logger.Warnf("Project %d build stopped after cleaning, %v", p.id, err)
+				request = <-p.queue
+			} else {
+				request = taskRequest{CLONING, 0, request.trigger, nil}
+			}
 		case CLONE_SUCCESS:
-			request = taskRequest{PREPARING, 0, request.trigger}
+			request = taskRequest{PREPARING, 0, request.trigger, nil}
 		case PREPARE_SUCCESS:
-			request = taskRequest{PULLING, 0, request.trigger}
+			p.buildHash = buildHash
+			db.Exec(`UPDATE projects SET buildHash = ? WHERE id = ?`, p.buildHash, p.id)
+			request = taskRequest{PULLING, 0, request.trigger, nil}
 		case PULL_SUCCESS:
-			buildHash := []byte{}
-			f, err := os.Open(fmt.Sprintf("%s/%d/%s", projectAbs, p.id, p.buildSpec))
-			if err == nil {
-				h := sha256.New()
-				io.Copy(h, f)
-				f.Close()
-				buildHash = h.Sum(nil)
+			reason := buildHashReason(p.buildHash, projectBuildHash(p))
+			if reason != "" {
+				logger.Infof("Project %d preparing again, %s", p.id, reason)
+				p.prepareReason = reason
+				request = taskRequest{PREPARING, 0, request.trigger, nil}
 			} else {
-				logger.Warn(err)
-			}
-			if !bytes.Equal(buildHash, p.buildHash) {
-				p.buildHash = buildHash
-				db.Exec(`UPDATE projects SET buildHash = ? WHERE id = ?`, buildHash, p.id)
-				request = taskRequest{PREPARING, 0, request.trigger}
-			} else {
-				request = taskRequest{BUILDING, 0, request.trigger}
+				request = taskRequest{BUILDING, 0, request.trigger, nil}
 			}
 		case BUILD_SUCCESS:
 			out, err := exec.Command("git", "-C", fmt.Sprintf("%s/%d/workspace/source", projectAbs, p.id), "rev-parse", "HEAD").Output()
 			if err == nil {
 				p.commit = strings.TrimSpace(string(out))
 			}
-			request = taskRequest{PREPACKAGING, 0, request.trigger}
+			request = taskRequest{PREPACKAGING, 0, request.trigger, nil}
 		case PREPACKAGING_SUCCESS:
-			request = taskRequest{PACKAGING, 0, request.trigger}
+			request = taskRequest{PACKAGING, 0, request.trigger, nil}
 		case PACKAGE_SUCCESS:
-			p.version += 1
+			version := projectRecordVersion(p, request.trigger)
 			db.Exec(`UPDATE projects SET version = ? WHERE id = ?`, p.version, p.id)
 			event(map[string]interface{}{
-				"event":   "project/version",
-				"id":      p.id,
-				"version": p.version,
+				"event":       "project/version",
+				"id":          p.id,
+				"version":     p.version,
+				"versionName": p.versionName,
 			})
-			_, err := exec.Command("git", "-C", fmt.Sprintf("%s/%d/workspace/source", projectAbs, p.id), "tag", fmt.Sprintf("r%d", p.version)).Output()
+			_, err := exec.Command("git", "-C", fmt.Sprintf("%s/%d/workspace/source", projectAbs, p.id), "tag", version.gitTag).Output()
 			if err != nil {
 				logger.Error(err)
 			}
-			request = taskRequest{PUSHING, 0, request.trigger}
+			_, err = exec.Command("podman", "tag", fmt.Sprintf("package-%d", p.id), fmt.Sprintf("package-%d:%d", p.id, p.version)).Output()
+			if err != nil {
+				logger.Error(err)
+			}
+			projectPruneImages(p, cfg.Images.Keep)
+			request = taskRequest{PUSHING, 0, request.trigger, nil}
 		case PUSH_SUCCESS:
 			index := request.index
-			if len(p.triggers) > 0 {
-				tag := ""
-				registry := ""
-				if index < len(p.destinations) {
-					destination := p.destinations[index]
-					tag = strings.Replace(destination.tag, "$VERSION", strconv.Itoa(p.version), -1)
-					registry = destination.registry.name
-				}
-				request2 := taskRequest{state, 0, &taskTrigger{p.url, p.branch, p.commit, tag, registry, p.id, p.version}}
-				for _, trigger := range p.triggers {
-					trigger.project.buildFrom(trigger.state, request2)
-				}
+			targets := request.promotion.targets
+			if index < len(targets) {
+				projectRecordDigest(p, p.version, targets[index])
+			}
+			if index+1 >= len(targets) {
+				fireTriggers(p, request, targets)
 			}
 			index = index + 1
-			if index < len(p.destinations) {
-				request = taskRequest{PUSHING, index, request.trigger}
+			if index < len(targets) {
+				request = taskRequest{PUSHING, index, request.trigger, request.promotion}
 			} else {
-				request = taskRequest{TAGGING, 0, request.trigger}
+				request = taskRequest{TAGGING, 0, request.trigger, nil}
 			}
 		case TAG_SUCCESS:
+			projectMeasureUsage(p)
+			request = <-p.queue
+		case TRIM_SUCCESS:
+			projectMeasureUsage(p)
+			request = <-p.queue
+		case PROMOTE_SUCCESS:
+			promotion := request.promotion
+			projectRecordDigest(p, promotion.version, promotion.targets[request.index])
 			index := request.index + 1
-			if index < len(p.destinations) {
-				request = taskRequest{TAGGING, index, request.trigger}
+			if index < len(promotion.targets) {
+				request = taskRequest{PROMOTING, index, request.trigger, promotion}
 			} else {
 				request = <-p.queue
 			}
 		case DELETE_SUCCESS:
+			projectPruneImages(p, 0)
 			db.Exec(`DELETE FROM projects WHERE id = ?`, p.id)
 			db.Exec(`DELETE FROM tasks WHERE project = ?`, p.id)
+			db.Exec(`DELETE FROM digests WHERE project = ?`, p.id)
+			db.Exec(`DELETE FROM versions WHERE project = ?`, p.id)
+			db.Exec(`DELETE FROM joins WHERE project = ?`, p.id)
+			projectDeleteRevisions(p)
+			scheduleDeleteProject(p)
+			fanInDeleteProject(p)
+			projectsMutex.Lock()
 			delete(projects, p.id)
+			projectsMutex.Unlock()
 			return
 		default:
+			if p.state >= CLEAN_ERROR && p.state <= TAG_ERROR && p.state%3 == 2 {
+				fireTriggers(p, request, nil)
+			}
+			// A failed stage may have left a partly built workspace or image behind
+			if p.state%3 == 2 {
+				projectMeasureUsage(p)
+			}
 			request = <-p.queue
 		}
 	}
 }
 
+func pushArgs(p *project, source string, target pushTarget) ([]string, error) {
+	url, err := registryLogin(target.registry)
+	digestFile := fmt.Sprintf("%s/%d/digest", projectAbs, p.id)
+	os.Remove(digestFile)
+	args := append([]string{"push", "--digestfile", digestFile}, registryTLSArgs(target.registry)...)
+	args = append(args, source, fmt.Sprintf("%s/%s", url, target.image))
+	return args, err
+}
+
+func projectRecordDigest(p *project, version int, target pushTarget) {
+	bytes, err := ioutil.ReadFile(fmt.Sprintf("%s/%d/digest", projectAbs, p.id))
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	digest := strings.TrimSpace(string(bytes))
+	image := fmt.Sprintf("%s/%s", target.registry.url, target.image)
+	db.Exec(`INSERT OR REPLACE INTO digests(project, version, registry, image, digest, time) VALUES(?, ?, ?, ?, ?, datetime('now'))`,
+		p.id, version, target.registry.id, image, digest)
+	logger.Infof("Project %d version %d pushed %s@%s", p.id, version, image, digest)
+	event(map[string]interface{}{
+		"event":       "project/version",
+		"id":          p.id,
+		"version":     p.version,
+		"versionName": p.versionName,
+		"pushed":      version,
+		"digests":     projectDigests(p.id, version),
+	})
+}
+
+func projectImageVersions(p *project) []int {
+	versions := make([]int, 0)
+	out, err := exec.Command("podman", "images", "--noheading", "--format", "{{.Tag}}", fmt.Sprintf("package-%d", p.id)).Output()
+	if err != nil {
+		logger.Error(err)
+		return versions
+	}
+	for _, tag := range strings.Fields(string(out)) {
+		version, err := strconv.Atoi(tag)
+		if err == nil {
+			versions = append(versions, version)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+	return versions
+}
+
+func projectHasImage(p *project, version int) bool {
+	return exec.Command("podman", "image", "exists", fmt.Sprintf("package-%d:%d", p.id, version)).Run() == nil
+}
+
+func projectPruneImages(p *project, keep int) {
+	for _, version := range projectImageVersions(p) {
+		if version <= p.version-keep {
+			logger.Infof("Removing image package-%d:%d", p.id, version)
+			_, err := exec.Command("podman", "rmi", fmt.Sprintf("package-%d:%d", p.id, version)).Output()
+			if err != nil {
+				logger.Error(err)
+			}
+		}
+	}
+}
+
+func projectDigests(pid, version int) []map[string]interface{} {
+	result := make([]map[string]interface{}, 0)
+	query := `SELECT version, registry, image, digest, time FROM digests WHERE project = ? ORDER BY version DESC, image`
+	args := []interface{}{pid}
+	if version > 0 {
+		query = `SELECT version, registry, image, digest, time FROM digests WHERE project = ? AND version = ? ORDER BY image`
+		args = append(args, version)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		logger.Error(err)
+		return result
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var rid int
+		var image string
+		var digest string
+		var time string
+		rows.Scan(&version, &rid, &image, &digest, &time)
+		result = append(result, map[string]interface{}{
+			"version":  version,
+			"registry": rid,
+			"image":    image,
+			"digest":   digest,
+			"time":     time,
+		})
+	}
+	return result
+}
+
+// Handlers and background routines look projects up concurrently with creation and deletion, so every access to
+// the projects map goes through these.
+func findProject(id int) *project {
+	projectsMutex.RLock()
+	defer projectsMutex.RUnlock()
+	return projects[id]
+}
+
+func snapshotProjects() map[int]*project {
+	projectsMutex.RLock()
+	defer projectsMutex.RUnlock()
+	snapshot := make(map[int]*project, len(projects))
+	for id, p := range projects {
+		snapshot[id] = p
+	}
+	return snapshot
+}
+
 func projectCreate(name, url, branch, labels string) *project {
 	var id int
 	db.QueryRow(`INSERT INTO projects(name, source, branch, labels, buildSpec, prepackageSpec, packageSpec, state, version)
 		VALUES(?, ?, ?, ?, 'BuildSpec', '', 'PackageSpec', 'CLONING', 0) RETURNING id`, name, url, branch, labels).Scan(&id)
-	logger.Infof("Project created %s %s %s %s", id, name, url, branch)
+	logger.Infof("Project created %d %s %s %s", id, name, url, branch)
 	os.Mkdir(fmt.Sprintf("%s/%d", projectAbs, id), 0777)
 	os.Mkdir(fmt.Sprintf("%s/%d/context", projectAbs, id), 0777)
 	os.Mkdir(fmt.Sprintf("%s/%d/workspace", projectAbs, id), 0777)
@@ -511,9 +825,15 @@ func projectCreate(name, url, branch, labels string) *project {
 		make([]trigger, 0),
 		make(map[string]*credential),
 		nil, nil, nil, "",
+		"counter", "VERSION", "", "r$BUILD", "", 0, nil, "", 0, nil,
 	}
+	projectsMutex.Lock()
 	projects[p.id] = p
-	go projectRoutine(p)
+	projectsMutex.Unlock()
+	// Projects created by the import command are only saved, the server builds them once it starts
+	if routinesStarted {
+		go projectRoutine(p)
+	}
 	event(map[string]interface{}{
 		"event":          "project/create",
 		"id":             p.id,
@@ -526,14 +846,20 @@ func projectCreate(name, url, branch, labels string) *project {
 		"packageSpec":    p.packageSpec,
 		"state":          p.state.String(),
 		"version":        p.version,
+		"versionName":    p.versionName,
 		"protected":      p.protected,
 		"tagRepo":        p.tagRepo,
+		"versioning":     p.versioning,
+		"versionFile":    p.versionFile,
+		"versionBump":    p.versionBump,
+		"gitTagFormat":   p.gitTagFormat,
+		"pollInterval":   p.pollInterval,
+		"quota":          p.quota,
+		"usage":          usageJSON(p),
 	})
 	return p
 }
 
-var staticPath, _ = filepath.Abs("static")
-
 func loadStatic(path string) ([]byte, error) {
 	path = filepath.Clean(path)
 	if path == "." {
@@ -544,7 +870,7 @@ func loadStatic(path string) ([]byte, error) {
 
 func projectList() []map[string]interface{} {
 	result := make([]map[string]interface{}, 0)
-	for id, p := range projects {
+	for id, p := range snapshotProjects() {
 		tasks := make([]interface{}, 0)
 		for _, task := range p.tasks {
 			tasks = append(tasks, map[string]interface{}{
@@ -560,12 +886,7 @@ func projectList() []map[string]interface{} {
 				destination.registry.id, destination.tag,
 			})
 		}
-		triggers := make([]interface{}, 0)
-		for _, trigger := range p.triggers {
-			triggers = append(triggers, []interface{}{
-				trigger.project.id, trigger.state.String(),
-			})
-		}
+		triggers := triggerList(p)
 		environment := make([]interface{}, 0)
 		for name, credential := range p.credentials {
 			environment = append(environment, []interface{}{
@@ -585,8 +906,17 @@ func projectList() []map[string]interface{} {
 			"state":          p.state.String(),
 			"tasks":          tasks,
 			"version":        p.version,
+			"versionName":    p.versionName,
 			"protected":      p.protected,
 			"tagRepo":        p.tagRepo,
+			"versioning":     p.versioning,
+			"versionFile":    p.versionFile,
+			"versionBump":    p.versionBump,
+			"gitTagFormat":   p.gitTagFormat,
+			"pollInterval":   p.pollInterval,
+			"quota":          p.quota,
+			"usage":          usageJSON(p),
+			"join":           fanInJSON(p.join),
 			"triggers":       triggers,
 			"environment":    environment,
 		})
@@ -657,13 +987,19 @@ func handleEvents(w http.ResponseWriter, r *http.Request, u *user, params map[st
 	events := make(chan []byte)
 	clients.register <- events
 	defer func() {
-		clients.unregister <- events
+		// The broker may be blocked sending to this client, keep reading until it takes the unregistration
+		for {
+			select {
+			case clients.unregister <- events:
+				return
+			case _, ok := <-events:
+				if !ok {
+					return
+				}
+			}
+		}
 	}()
 	notify := w.(http.CloseNotifier).CloseNotify()
-	go func() {
-		<-notify
-		clients.unregister <- events
-	}()
 	j, _ := json.Marshal(map[string]interface{}{
 		"event":    "project/list",
 		"projects": projectList(),
@@ -671,8 +1007,16 @@ func handleEvents(w http.ResponseWriter, r *http.Request, u *user, params map[st
 	fmt.Fprintf(w, "data: %s\n\n", j)
 	flusher.Flush()
 	for {
-		fmt.Fprintf(w, "data: %s\n\n", <-events)
-		flusher.Flush()
+		select {
+		case data, ok := <-events:
+			if !ok {
+				return
+			}
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+		case <-notify:
+			return
+		}
 	}
 }
 
@@ -769,7 +1113,7 @@ func handleProjectList(w http.ResponseWriter, r *http.Request, u *user, params m
 
 func handleProjectStatus(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
 	id, _ := strconv.Atoi(params["id"])
-	p := projects[id]
+	p := findProject(id)
 	if p == nil {
 		w.WriteHeader(500)
 	} else {
@@ -797,12 +1141,7 @@ func projectUpdateEvent(p *project) {
 			destination.registry.id, destination.tag,
 		})
 	}
-	triggers := make([]interface{}, 0)
-	for _, trigger := range p.triggers {
-		triggers = append(triggers, []interface{}{
-			trigger.project.id, trigger.state.String(),
-		})
-	}
+	triggers := triggerList(p)
 	environment := make([]interface{}, 0)
 	for name, credential := range p.credentials {
 		environment = append(environment, []interface{}{
@@ -822,45 +1161,83 @@ func projectUpdateEvent(p *project) {
 		"packageSpec":    p.packageSpec,
 		"protected":      p.protected,
 		"tagRepo":        p.tagRepo,
+		"versioning":     p.versioning,
+		"versionFile":    p.versionFile,
+		"versionBump":    p.versionBump,
+		"gitTagFormat":   p.gitTagFormat,
+		"pollInterval":   p.pollInterval,
+		"quota":          p.quota,
+		"usage":          usageJSON(p),
+		"join":           fanInJSON(p.join),
 		"triggers":       triggers,
 		"environment":    environment,
 	})
 }
 
+func projectSave(p *project) {
+	db.Exec(`UPDATE projects SET name = ?, labels = ?, source = ?, branch = ?, buildSpec = ?, prepackageSpec = ?, packageSpec = ?, protected = ?, tagRepo = ?,
+		versioning = ?, versionFile = ?, gitTagFormat = ?, pollInterval = ?, quota = ? WHERE id = ?`,
+		p.name, p.labels, p.url, p.branch, p.buildSpec, p.prepackageSpec, p.packageSpec, p.protected, p.tagRepo,
+		p.versioning, p.versionFile, p.gitTagFormat, p.pollInterval, p.quota, p.id)
+	exec.Command("git", "-C", fmt.Sprintf("%s/%d/workspace/source", projectAbs, p.id), "remote", "set-url", "origin", p.url).Output()
+}
+
+// An empty spec path means the stage has no spec, anything else is cleaned.
+func cleanSpec(name string) string {
+	if name == "" {
+		return ""
+	}
+	return filepath.Clean(name)
+}
+
 func handleProjectUpdate(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
 	if checkLogin(u, "admin", w, "/project/update", params) {
 		return
 	}
 	id, _ := strconv.Atoi(params["id"])
-	p := projects[id]
+	p := findProject(id)
+	var pollInterval int
+	var err error
+	// A missing setting keeps its current value, an empty one disables polling or the quota.
+	if value, ok := params["pollInterval"]; ok {
+		pollInterval, err = parsePollInterval(value)
+	} else if p != nil {
+		pollInterval = p.pollInterval
+	}
+	var quota int64
+	if value, ok := params["quota"]; ok && err == nil {
+		quota, err = parseQuota(value)
+	} else if p != nil {
+		quota = p.quota
+	}
 	if p == nil {
 		w.WriteHeader(500)
+	} else if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
 	} else {
 		p.name = params["name"]
 		p.labels = params["labels"]
 		p.url = params["url"]
 		p.branch = params["branch"]
-		if params["buildSpec"] != "" {
-			p.buildSpec = filepath.Clean(params["buildSpec"])
-		} else {
-			p.buildSpec = ""
+		p.buildSpec = cleanSpec(params["buildSpec"])
+		p.prepackageSpec = cleanSpec(params["prepackageSpec"])
+		p.packageSpec = cleanSpec(params["packageSpec"])
+		p.protected = params["protected"] != ""
+		p.tagRepo = params["tagRepo"] != ""
+		if versionSchemes[params["versioning"]] {
+			p.versioning = params["versioning"]
 		}
-		if params["prepackageSpec"] != "" {
-			p.prepackageSpec = filepath.Clean(params["prepackageSpec"])
-		} else {
-			p.prepackageSpec = ""
+		if params["versionFile"] != "" {
+			p.versionFile = filepath.Clean(params["versionFile"])
 		}
-		if params["packageSpec"] != "" {
-			p.packageSpec = filepath.Clean(params["packageSpec"])
-		} else {
-			p.packageSpec = ""
+		if params["gitTagFormat"] != "" {
+			p.gitTagFormat = params["gitTagFormat"]
 		}
-		p.protected = params["protected"] != ""
-		p.tagRepo = params["tagRepo"] != ""
-		db.Exec(`UPDATE projects SET name = ?, labels = ?, source = ?, branch = ?, buildSpec = ?, prepackageSpec = ?, packageSpec = ?, protected = ?, tagRepo = ? WHERE id = ?`,
-			p.name, p.labels, p.url, p.branch, p.buildSpec, p.prepackageSpec, p.packageSpec, p.protected, p.tagRepo, p.id)
+		p.pollInterval = pollInterval
+		p.quota = quota
+		projectSave(p)
 		projectUpdateEvent(p)
-		exec.Command("git", "-C", fmt.Sprintf("%s/%d/workspace/source", projectAbs, p.id), "remote", "set-url", "origin", p.url).Output()
 		redirect := params["redirect"]
 		if len(redirect) > 0 {
 			w.Header().Add("Location", redirect)
@@ -891,12 +1268,100 @@ func handleProjectCreate(w http.ResponseWriter, r *http.Request, u *user, params
 	}
 }
 
+// Creates a project from an existing one, copying its settings, spec files, context, destinations and environment.
+// Triggers, schedules and joins refer to other projects and are not copied.
+func projectClone(source *project, name, url, branch, labels, author string) *project {
+	p := projectCreate(name, url, branch, labels)
+	p.buildSpec = source.buildSpec
+	p.prepackageSpec = source.prepackageSpec
+	p.packageSpec = source.packageSpec
+	p.protected = source.protected
+	p.tagRepo = source.tagRepo
+	p.versioning = source.versioning
+	p.versionFile = source.versionFile
+	p.gitTagFormat = source.gitTagFormat
+	p.pollInterval = source.pollInterval
+	p.quota = source.quota
+	projectSave(p)
+	entries, _ := ioutil.ReadDir(fmt.Sprintf("%s/%d", projectAbs, source.id))
+	for _, entry := range entries {
+		switch entry.Name() {
+		case "workspace", "environment", "digest":
+			continue
+		case "context":
+			os.RemoveAll(fmt.Sprintf("%s/%d/context", projectAbs, p.id))
+		}
+		out, err := exec.Command("cp", "-a", fmt.Sprintf("%s/%d/%s", projectAbs, source.id, entry.Name()),
+			fmt.Sprintf("%s/%d/%s", projectAbs, p.id, entry.Name())).CombinedOutput()
+		if err != nil {
+			logger.Errorf("Copying %s from project %d: %v %s", entry.Name(), source.id, err, out)
+		}
+	}
+	projectRecordSpecFiles(p, author)
+	projectSetDestinations(p, append([]destination{}, source.destinations...))
+	environment := make(map[string]*credential)
+	for name, credential := range source.credentials {
+		environment[name] = credential
+	}
+	projectSetEnvironment(p, environment)
+	projectUpdateEvent(p)
+	logger.Infof("Project %d cloned from %d", p.id, source.id)
+	return p
+}
+
+func handleProjectClone(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/clone", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	source := findProject(id)
+	if source == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Project not found"))
+		return
+	}
+	name := params["name"]
+	if name == "" {
+		w.WriteHeader(400)
+		w.Write([]byte("A new name is required"))
+		return
+	}
+	for _, q := range snapshotProjects() {
+		if q.name == name {
+			w.WriteHeader(409)
+			w.Write([]byte(fmt.Sprintf("Project %s already exists", name)))
+			return
+		}
+	}
+	url := params["url"]
+	if url == "" {
+		url = source.url
+	}
+	branch := params["branch"]
+	if branch == "" {
+		branch = source.branch
+	}
+	labels, ok := params["labels"]
+	if !ok {
+		labels = source.labels
+	}
+	p := projectClone(source, name, url, branch, labels, u.Name)
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(201)
+		w.Write([]byte(strconv.Itoa(p.id)))
+	}
+}
+
 func handleProjectUpload(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
 	if r.MultipartForm != nil {
 		files := r.MultipartForm.File["file"]
 		if (files != nil) && (len(files) > 0) {
 			file := files[0]
-			temp, _ := ioutil.TempFile("uploads", "upload-")
+			temp, _ := ioutil.TempFile(uploadAbs, "upload-")
 			rd, _ := file.Open()
 			io.Copy(temp, rd)
 			temp.Close()
@@ -905,7 +1370,7 @@ func handleProjectUpload(w http.ResponseWriter, r *http.Request, u *user, params
 		}
 	}
 	if params["value"] != "" {
-		temp, _ := ioutil.TempFile("uploads", "upload-")
+		temp, _ := ioutil.TempFile(uploadAbs, "upload-")
 		temp.WriteString(params["value"])
 		temp.Close()
 		params["upload"] = temp.Name()
@@ -916,18 +1381,49 @@ func handleProjectUpload(w http.ResponseWriter, r *http.Request, u *user, params
 	id, _ := strconv.Atoi(params["id"])
 	name := filepath.Clean(params["name"])
 	upload := filepath.Clean(params["upload"])
-	validUpload, _ := regexp.MatchString("^uploads/upload-[0-9]+$", upload)
-	p := projects[id]
+	validUpload, _ := regexp.MatchString("^upload-[0-9]+$", filepath.Base(upload))
+	validUpload = validUpload && filepath.Dir(upload) == uploadAbs
+	extract, _ := strconv.ParseBool(params["extract"])
+	replace, _ := strconv.ParseBool(params["replace"])
+	p := findProject(id)
 	if p == nil {
 		w.WriteHeader(500)
+	} else if extract && validUpload {
+		if params["name"] == "" {
+			name = "context"
+		}
+		err := projectExtract(p, upload, name, replace)
+		os.Remove(upload)
+		if err != nil {
+			logger.Errorf("Project %d extract: %v", p.id, err)
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		projectRecordSpecFiles(p, u.Name)
+		logger.Infof("Project %d extracted archive to %s", p.id, name)
+		redirect := params["redirect"]
+		if len(redirect) > 0 {
+			w.Header().Add("Location", redirect)
+			w.WriteHeader(303)
+		} else {
+			w.WriteHeader(200)
+			w.Write([]byte("OK"))
+		}
 	} else if name == "." {
 		w.WriteHeader(500)
 	} else if !validUpload {
 		w.WriteHeader(500)
 	} else {
-		err := os.Rename(upload, fmt.Sprintf("%s/%d/%s", projectAbs, id, name))
+		filename := fmt.Sprintf("%s/%d/%s", projectAbs, id, name)
+		err := os.Rename(upload, filename)
 		if err != nil {
 			logger.Error(err)
+		} else if content, err := ioutil.ReadFile(filename); err == nil {
+			_, err = projectRecordRevision(p, name, content, u.Name)
+			if err != nil {
+				logger.Error(err)
+			}
 		}
 		redirect := params["redirect"]
 		if len(redirect) > 0 {
@@ -940,24 +1436,31 @@ func handleProjectUpload(w http.ResponseWriter, r *http.Request, u *user, params
 	}
 }
 
+func projectSetDestinations(p *project, destinations []destination) {
+	p.destinations = destinations
+	db.Exec(`DELETE FROM destinations WHERE project = ?`, p.id)
+	for _, destination := range destinations {
+		db.Exec(`INSERT INTO destinations(project, registry, tag) VALUES(?, ?, ?)`, p.id, destination.registry.id, destination.tag)
+	}
+}
+
 func handleProjectDestinations(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
 	if checkLogin(u, "admin", w, "/project/destinations", params) {
 		return
 	}
 	pid, _ := strconv.Atoi(params["id"])
-	p := projects[pid]
-	p.destinations = make([]destination, 0)
-	db.Exec(`DELETE FROM destinations WHERE project = ?`, p.id)
-	destinations := strings.FieldsFunc(params["destinations"], func(c rune) bool {
+	p := findProject(pid)
+	fields := strings.FieldsFunc(params["destinations"], func(c rune) bool {
 		return c == ','
 	})
-	for i := 0; i < len(destinations); i += 2 {
-		rid, _ := strconv.Atoi(destinations[i])
-		r := registries[rid]
-		tag := destinations[i+1]
-		p.destinations = append(p.destinations, destination{r, tag})
-		db.Exec(`INSERT INTO destinations(project, registry, tag) VALUES(?, ?, ?)`, p.id, r.id, tag)
+	destinations := make([]destination, 0)
+	for i := 0; i < len(fields); i += 2 {
+		rid, _ := strconv.Atoi(fields[i])
+		if r := registries[rid]; r != nil {
+			destinations = append(destinations, destination{r, fields[i+1]})
+		}
 	}
+	projectSetDestinations(p, destinations)
 	projectUpdateEvent(p)
 	redirect := params["redirect"]
 	if len(redirect) > 0 {
@@ -969,12 +1472,7 @@ func handleProjectDestinations(w http.ResponseWriter, r *http.Request, u *user,
 	}
 }
 
-func handleProjectTriggers(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
-	if checkLogin(u, "admin", w, "/project/triggers", params) {
-		return
-	}
-	pid, _ := strconv.Atoi(params["id"])
-	p := projects[pid]
+func projectSetTriggers(p *project, triggers []trigger) {
 	for _, trigger := range p.triggers {
 		switch trigger.state {
 		case PREPARING:
@@ -985,41 +1483,56 @@ func handleProjectTriggers(w http.ResponseWriter, r *http.Request, u *user, para
 			trigger.project.packageDep = nil
 		}
 	}
-	p.triggers = make([]trigger, 0)
+	p.triggers = triggers
 	db.Exec(`DELETE FROM triggers WHERE project = ?`, p.id)
-	triggers := strings.FieldsFunc(params["triggers"], func(c rune) bool {
-		return c == ','
-	})
-	for i := 0; i < len(triggers); i += 2 {
-		tid, _ := strconv.Atoi(triggers[i])
-		t := projects[tid]
-		s := NONE
-		switch triggers[i+1] {
-		case "clean":
-			s = CLEANING
-		case "clone":
-			s = CLONING
-		case "prepare":
-			s = PREPARING
-			t.prepareDep = p
-		case "pull":
-			s = PULLING
-		case "build":
-			s = BUILDING
-		case "prepackage":
-			s = PREPACKAGING
-			t.prepackageDep = p
-		case "package":
-			s = PACKAGING
-			t.packageDep = p
-		case "push":
-			s = PUSHING
-		case "tag":
-			s = TAGGING
+	for _, trigger := range p.triggers {
+		switch trigger.state {
+		case PREPARING:
+			trigger.project.prepareDep = p
+		case PREPACKAGING:
+			trigger.project.prepackageDep = p
+		case PACKAGING:
+			trigger.project.packageDep = p
 		}
-		p.triggers = append(p.triggers, trigger{t, s})
-		db.Exec(`INSERT INTO triggers(project, target, state) VALUES(?, ?, ?)`, p.id, t.id, s.String())
+		variables, _ := json.Marshal(trigger.variables)
+		db.Exec(`INSERT INTO triggers(project, target, state, event, branches, tags, labels, variables) VALUES(?, ?, ?, ?, ?, ?, ?, ?)`,
+			p.id, trigger.project.id, trigger.state.String(), trigger.on, trigger.branches, trigger.tags, trigger.labels, string(variables))
+	}
+}
+
+func handleProjectTriggers(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/triggers", params) {
+		return
 	}
+	pid, _ := strconv.Atoi(params["id"])
+	p := findProject(pid)
+	if p == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Project not found"))
+		return
+	}
+	specs, err := parseTriggerSpecs(params["triggers"])
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	triggers := make([]trigger, 0)
+	for _, spec := range specs {
+		t, err := spec.trigger()
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		triggers = append(triggers, t)
+	}
+	if cycle := findCycle(triggerEdges(p, triggers), p.id); cycle != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("Trigger cycle %s", formatCycle(cycle))))
+		return
+	}
+	projectSetTriggers(p, triggers)
 	projectUpdateEvent(p)
 	redirect := params["redirect"]
 	if len(redirect) > 0 {
@@ -1031,26 +1544,31 @@ func handleProjectTriggers(w http.ResponseWriter, r *http.Request, u *user, para
 	}
 }
 
+func projectSetEnvironment(p *project, environment map[string]*credential) {
+	p.credentials = environment
+	db.Exec(`DELETE FROM environments WHERE project = ?`, p.id)
+	for name, cr := range environment {
+		db.Exec(`INSERT INTO environments(project, name, credential) VALUES(?, ?, ?)`, p.id, name, cr.id)
+	}
+}
+
 func handleProjectEnvironment(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
 	if checkLogin(u, "admin", w, "/project/environment", params) {
 		return
 	}
 	pid, _ := strconv.Atoi(params["id"])
-	p := projects[pid]
-	p.credentials = make(map[string]*credential)
-	db.Exec(`DELETE FROM environments WHERE project = ?`, p.id)
-	environment := strings.FieldsFunc(params["environment"], func(c rune) bool {
+	p := findProject(pid)
+	fields := strings.FieldsFunc(params["environment"], func(c rune) bool {
 		return c == ','
 	})
-	for i := 0; i < len(environment); i += 2 {
-		name := environment[i]
-		crid, _ := strconv.Atoi(environment[i+1])
-		cr := credentials[crid]
-		if cr != nil {
-			p.credentials[name] = cr
-			db.Exec(`INSERT INTO environments(project, name, credential) VALUES(?, ?, ?)`, p.id, name, cr.id)
+	environment := make(map[string]*credential)
+	for i := 0; i < len(fields); i += 2 {
+		crid, _ := strconv.Atoi(fields[i+1])
+		if cr := credentials[crid]; cr != nil {
+			environment[fields[i]] = cr
 		}
 	}
+	projectSetEnvironment(p, environment)
 	projectUpdateEvent(p)
 	redirect := params["redirect"]
 	if len(redirect) > 0 {
@@ -1065,12 +1583,20 @@ func handleProjectEnvironment(w http.ResponseWriter, r *http.Request, u *user, p
 func handleProjectBuild(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
 	id, _ := strconv.Atoi(params["id"])
 	stage := params["stage"]
-	p := projects[id]
+	p := findProject(id)
 	if p.protected && u.Name == "" {
 		w.WriteHeader(403)
 		w.Write([]byte("Unauthorized"))
 		return
 	}
+	if isDraining() {
+		writeBuildError(w, errDraining)
+		return
+	}
+	if err := projectCheckQuota(p, stageNames[stage]); err != nil {
+		writeBuildError(w, err)
+		return
+	}
 	expectedRef := fmt.Sprintf("refs/heads/%s", p.branch)
 	requestedRef := expectedRef
 	if params["payload"] != "" {
@@ -1079,25 +1605,32 @@ func handleProjectBuild(w http.ResponseWriter, r *http.Request, u *user, params
 		requestedRef = fmt.Sprint(j["ref"])
 	}
 	if requestedRef == expectedRef {
+		var err error
 		switch stage {
 		case "clean":
-			p.buildFrom(CLEANING, defaultRequest)
+			err = p.buildFrom(CLEANING, defaultRequest)
 		case "clone":
-			p.buildFrom(CLONING, defaultRequest)
+			err = p.buildFrom(CLONING, defaultRequest)
 		case "prepare":
-			p.buildFrom(PREPARING, defaultRequest)
+			err = p.buildFrom(PREPARING, defaultRequest)
 		case "pull":
-			p.buildFrom(PULLING, defaultRequest)
+			err = p.buildFrom(PULLING, defaultRequest)
 		case "build":
-			p.buildFrom(BUILDING, defaultRequest)
+			err = p.buildFrom(BUILDING, defaultRequest)
 		case "prepackage":
-			p.buildFrom(PREPACKAGING, defaultRequest)
+			err = p.buildFrom(PREPACKAGING, defaultRequest)
 		case "package":
-			p.buildFrom(PACKAGING, defaultRequest)
+			err = p.buildFrom(PACKAGING, defaultRequest)
 		case "push":
-			p.buildFrom(PUSHING, defaultRequest)
+			err = p.buildFrom(PUSHING, defaultRequest)
 		case "tag":
-			p.buildFrom(TAGGING, defaultRequest)
+			err = p.buildFrom(TAGGING, defaultRequest)
+		case "trim":
+			err = p.buildFrom(TRIMMING, defaultRequest)
+		}
+		if err != nil {
+			writeBuildError(w, err)
+			return
 		}
 	} else {
 		logger.Infof("Build requested by %s expected %s, skipping", requestedRef, expectedRef)
@@ -1106,6 +1639,130 @@ func handleProjectBuild(w http.ResponseWriter, r *http.Request, u *user, params
 	w.Write([]byte("OK"))
 }
 
+func handleProjectDigests(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	version, _ := strconv.Atoi(params["version"])
+	if findProject(id) == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Project not found"))
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(projectDigests(id, version))
+	w.Write(j)
+}
+
+func handleProjectPromote(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/promote", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := findProject(id)
+	if p == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Project not found"))
+		return
+	}
+	version := parseProjectVersion(p, params["version"])
+	if version <= 0 || version > p.version {
+		w.WriteHeader(400)
+		w.Write([]byte("Invalid version"))
+		return
+	}
+	if !projectHasImage(p, version) {
+		w.WriteHeader(404)
+		w.Write([]byte(fmt.Sprintf("Image for version %d is no longer available", version)))
+		return
+	}
+	rid, _ := strconv.Atoi(params["registry"])
+	reg := registries[rid]
+	tag := params["tag"]
+	if reg == nil || tag == "" {
+		w.WriteHeader(400)
+		w.Write([]byte("Invalid destination"))
+		return
+	}
+	if err := p.promote(version, []destination{{reg, tag}}); err != nil {
+		if errors.Is(err, errDraining) {
+			w.WriteHeader(503)
+		} else {
+			w.WriteHeader(400)
+		}
+		w.Write([]byte(err.Error()))
+		return
+	}
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
+
+func handleProjectRollback(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/rollback", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := findProject(id)
+	if p == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Project not found"))
+		return
+	}
+	version := parseProjectVersion(p, params["version"])
+	if version <= 0 || version > p.version {
+		w.WriteHeader(400)
+		w.Write([]byte("Invalid version"))
+		return
+	}
+	if !projectHasImage(p, version) {
+		w.WriteHeader(404)
+		w.Write([]byte(fmt.Sprintf("Image for version %d is no longer available", version)))
+		return
+	}
+	if len(p.destinations) == 0 {
+		w.WriteHeader(400)
+		w.Write([]byte("Project has no destinations"))
+		return
+	}
+	destinations := make([]destination, len(p.destinations))
+	copy(destinations, p.destinations)
+	if err := p.promote(version, destinations); err != nil {
+		if errors.Is(err, errDraining) {
+			w.WriteHeader(503)
+		} else {
+			w.WriteHeader(400)
+		}
+		w.Write([]byte(err.Error()))
+		return
+	}
+	logger.Infof("Project %d rolling back to version %d", p.id, version)
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
+
+func handleProjectImages(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	p := findProject(id)
+	if p == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Project not found"))
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(projectImageVersions(p))
+	w.Write(j)
+}
+
 func handleProjectDelete(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
 	if checkLogin(u, "admin", w, "/project/delete", params) {
 		return
@@ -1113,7 +1770,10 @@ func handleProjectDelete(w http.ResponseWriter, r *http.Request, u *user, params
 	id, _ := strconv.Atoi(params["id"])
 	confirm := params["confirm"]
 	if confirm == "YES" {
-		projects[id].buildFrom(DELETING, defaultRequest)
+		if err := findProject(id).buildFrom(DELETING, defaultRequest); err != nil {
+			writeBuildError(w, err)
+			return
+		}
 	}
 	redirect := params["redirect"]
 	if len(redirect) > 0 {
@@ -1154,7 +1814,7 @@ func handleTaskLogs(w http.ResponseWriter, r *http.Request, u *user, params map[
 	var state string
 	db.QueryRow(`SELECT state FROM tasks WHERE id = ?`, id).Scan(&state)
 	offset, _ := strconv.ParseInt(params["offset"], 10, 64)
-	file, _ := os.Open(fmt.Sprintf("tasks/%d/out.log", id))
+	file, _ := os.Open(fmt.Sprintf("%s/%d/out.log", taskAbs, id))
 	file.Seek(offset, 0)
 	bytes, _ := ioutil.ReadAll(file)
 	w.Header().Add("Content-Type", "text/plain")
@@ -1175,10 +1835,14 @@ func handleRegistryCreate(w http.ResponseWriter, r *http.Request, u *user, param
 	}
 	name := params["name"]
 	url := params["url"]
-	user := params["user"]
-	password := params["password"]
+	crid, _ := strconv.Atoi(params["credential"])
+	auth := params["auth"]
+	if auth == "" {
+		auth = "basic"
+	}
 	timeout, _ := strconv.Atoi(params["timeout"])
-	reg := registryCreate(name, url, user, password, timeout)
+	insecure, _ := strconv.ParseBool(params["insecure"])
+	reg := registryCreate(name, url, credentials[crid], auth, params["ca"], insecure, timeout)
 	redirect := params["redirect"]
 	if len(redirect) > 0 {
 		w.Header().Add("Location", redirect)
@@ -1197,10 +1861,22 @@ func handleRegistryUpdate(w http.ResponseWriter, r *http.Request, u *user, param
 	reg := registries[id]
 	reg.name = params["name"]
 	reg.url = params["url"]
-	reg.user = params["user"]
-	reg.password = params["password"]
+	crid, _ := strconv.Atoi(params["credential"])
+	reg.credential = credentials[crid]
+	reg.auth = params["auth"]
+	if reg.auth == "" {
+		reg.auth = "basic"
+	}
+	reg.ca = params["ca"]
+	reg.insecure, _ = strconv.ParseBool(params["insecure"])
 	reg.timeout, _ = strconv.Atoi(params["timeout"])
-	db.Exec(`UPDATE registries SET name = ?, url = ?, user = ?, password = ?, timeout = ? WHERE id = ?`, reg.name, reg.url, reg.user, reg.password, reg.timeout, reg.id)
+	reg.login = time.Unix(0, 0)
+	registryWriteCA(reg)
+	if reg.credential == nil {
+		crid = 0
+	}
+	db.Exec(`UPDATE registries SET name = ?, url = ?, credential = ?, auth = ?, ca = ?, insecure = ?, timeout = ? WHERE id = ?`,
+		reg.name, reg.url, crid, reg.auth, reg.ca, reg.insecure, reg.timeout, reg.id)
 	redirect := params["redirect"]
 	if len(redirect) > 0 {
 		w.Header().Add("Location", redirect)
@@ -1211,6 +1887,66 @@ func handleRegistryUpdate(w http.ResponseWriter, r *http.Request, u *user, param
 	}
 }
 
+func handleRegistryDelete(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/registry/delete", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	reg := registries[id]
+	if reg == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Registry not found"))
+		return
+	}
+	references := make([]*project, 0)
+	for _, p := range snapshotProjects() {
+		for _, destination := range p.destinations {
+			if destination.registry == reg {
+				references = append(references, p)
+				break
+			}
+		}
+	}
+	cascade, _ := strconv.ParseBool(params["cascade"])
+	if len(references) > 0 && !cascade {
+		names := make([]string, 0)
+		for _, p := range references {
+			names = append(names, p.name)
+		}
+		sort.Strings(names)
+		w.WriteHeader(409)
+		w.Write([]byte(fmt.Sprintf("Registry used by projects: %s", strings.Join(names, ", "))))
+		return
+	}
+	db.Exec(`DELETE FROM destinations WHERE registry = ?`, reg.id)
+	db.Exec(`DELETE FROM registries WHERE id = ?`, reg.id)
+	delete(registries, reg.id)
+	os.RemoveAll(registryCertDir(reg))
+	for _, p := range references {
+		destinations := make([]destination, 0)
+		for _, destination := range p.destinations {
+			if destination.registry != reg {
+				destinations = append(destinations, destination)
+			}
+		}
+		p.destinations = destinations
+		projectUpdateEvent(p)
+	}
+	logger.Infof("Registry deleted %d %s", reg.id, reg.name)
+	event(map[string]interface{}{
+		"event": "registry/delete",
+		"id":    reg.id,
+	})
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
+
 func handleCredentialList(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
 	result := make([]map[string]interface{}, 0)
 	for id, cr := range credentials {
@@ -1234,10 +1970,11 @@ func handleCredentialCreate(w http.ResponseWriter, r *http.Request, u *user, par
 		return
 	}
 	description := params["description"]
+	user := params["user"]
 	value := params["value"]
 	var id int
-	db.QueryRow(`INSERT INTO credentials(description, value) VALUES(?, ?) RETURNING id`, description, value).Scan(&id)
-	credentials[id] = &credential{id, description, value}
+	db.QueryRow(`INSERT INTO credentials(description, user, value) VALUES(?, ?, ?) RETURNING id`, description, user, value).Scan(&id)
+	credentials[id] = &credential{id, description, user, value}
 	redirect := params["redirect"]
 	if len(redirect) > 0 {
 		w.Header().Add("Location", redirect)
@@ -1256,7 +1993,15 @@ func handleCredentialUpdate(w http.ResponseWriter, r *http.Request, u *user, par
 	value := params["value"]
 	cr := credentials[id]
 	cr.value = value
-	db.Exec(`UPDATE credentials SET value = ? WHERE id = ?`, value, id)
+	if params["user"] != "" {
+		cr.user = params["user"]
+	}
+	db.Exec(`UPDATE credentials SET user = ?, value = ? WHERE id = ?`, cr.user, value, id)
+	for _, reg := range registries {
+		if reg.credential == cr {
+			reg.login = time.Unix(0, 0)
+		}
+	}
 	redirect := params["redirect"]
 	if len(redirect) > 0 {
 		w.Header().Add("Location", redirect)
@@ -1268,6 +2013,73 @@ func handleCredentialUpdate(w http.ResponseWriter, r *http.Request, u *user, par
 }
 
 func handleCredentialDelete(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/credential/delete", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	cr := credentials[id]
+	if cr == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Credential not found"))
+		return
+	}
+	references := make([]*project, 0)
+	for _, p := range snapshotProjects() {
+		for _, pcr := range p.credentials {
+			if pcr == cr {
+				references = append(references, p)
+				break
+			}
+		}
+	}
+	regReferences := make([]*registry, 0)
+	for _, reg := range registries {
+		if reg.credential == cr {
+			regReferences = append(regReferences, reg)
+		}
+	}
+	cascade, _ := strconv.ParseBool(params["cascade"])
+	if (len(references) > 0 || len(regReferences) > 0) && !cascade {
+		names := make([]string, 0)
+		for _, p := range references {
+			names = append(names, p.name)
+		}
+		for _, reg := range regReferences {
+			names = append(names, fmt.Sprintf("registry %s", reg.name))
+		}
+		sort.Strings(names)
+		w.WriteHeader(409)
+		w.Write([]byte(fmt.Sprintf("Credential used by: %s", strings.Join(names, ", "))))
+		return
+	}
+	for _, reg := range regReferences {
+		reg.credential = nil
+		db.Exec(`UPDATE registries SET credential = 0 WHERE id = ?`, reg.id)
+	}
+	db.Exec(`DELETE FROM environments WHERE credential = ?`, cr.id)
+	db.Exec(`DELETE FROM credentials WHERE id = ?`, cr.id)
+	delete(credentials, cr.id)
+	for _, p := range references {
+		for name, pcr := range p.credentials {
+			if pcr == cr {
+				delete(p.credentials, name)
+			}
+		}
+		projectUpdateEvent(p)
+	}
+	logger.Infof("Credential deleted %d %s", cr.id, cr.description)
+	event(map[string]interface{}{
+		"event": "credential/delete",
+		"id":    cr.id,
+	})
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
 }
 
 type handler func(w http.ResponseWriter, r *http.Request, u *user, params map[string]string)
@@ -1349,26 +2161,82 @@ func handleRoot(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	var configFile string
 	var sslCert, sslKey string
 	var port int
+	var noLoginFlag bool
+	var minFreeSpaceFlag int64
+	flag.StringVar(&configFile, "config", defaultConfigFile, "Configuration file")
 	flag.StringVar(&sslCert, "ssl-cert", "", "SSL cert")
 	flag.StringVar(&sslKey, "ssl-key", "", "SSL key")
-	flag.BoolVar(&noLogin, "no-login", false, "Allow all actions without login")
+	flag.BoolVar(&noLoginFlag, "no-login", false, "Allow all actions without login")
 	flag.IntVar(&port, "port", 8080, "Web server port")
+	flag.Int64Var(&minFreeSpaceFlag, "min-free-space", 1024, "Minimum free disk space in MB for readiness")
 	flag.Parse()
 
+	if flag.Arg(0) == "config" {
+		switch flag.Arg(1) {
+		case "check":
+			os.Exit(configCheck(configFile))
+		default:
+			fmt.Fprintln(os.Stderr, "Usage: racs [-config file] config check")
+			os.Exit(2)
+		}
+	}
+
+	c, err := loadConfig(configFile)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "ssl-cert":
+			c.SSLCert = sslCert
+		case "ssl-key":
+			c.SSLKey = sslKey
+		case "no-login":
+			c.NoLogin = noLoginFlag
+		case "port":
+			c.Port = port
+		case "min-free-space":
+			c.MinFreeSpace = minFreeSpaceFlag
+		}
+	})
+	errs := c.check()
+	for _, err := range errs {
+		logger.Error(err)
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+	applyConfig(c)
+
 	key := make([]byte, 32)
 	rand.Read(key)
 	ciph, _ = aes.NewCipher(key)
 
-	var err error
-
-	os.Mkdir("projects", 0777)
-	os.Mkdir("tasks", 0777)
-	os.Mkdir("uploads", 0777)
+	os.Mkdir(projectAbs, 0777)
+	os.Mkdir(taskAbs, 0777)
+	os.Mkdir(uploadAbs, 0777)
+	os.Mkdir(certAbs, 0700)
 	os.Setenv("GIT_TERMINAL_PROMPT", "0")
 
-	db, err = sql.Open("sqlite3", "file:main.db?cache=shared")
+	if flag.Arg(0) == "restore" {
+		os.Exit(restoreCommand(flag.Args()[1:]))
+	}
+
+	// Backups are consistent snapshots and can be taken while a server is running, everything else needs the
+	// database to itself
+	if flag.Arg(0) != "backup" {
+		lock, err := lockDatabase()
+		if err != nil {
+			logger.Fatal(err)
+			os.Exit(-1)
+		}
+		defer lock.Close()
+	}
+
+	db, err = sql.Open("sqlite3", fmt.Sprintf("file:%s?cache=shared", cfg.Paths.Database))
 	if err != nil {
 		logger.Fatal(err)
 		os.Exit(-1)
@@ -1379,7 +2247,7 @@ func main() {
 	var version int
 	err = db.QueryRow(`SELECT value FROM config WHERE name = 'version'`).Scan(&version)
 	if err != nil {
-		bytes, _ := ioutil.ReadFile("schemas/current.sql")
+		bytes, _ := ioutil.ReadFile(fmt.Sprintf("%s/current.sql", schemaPath))
 		stats := strings.Split(string(bytes), ";")
 		for _, stat := range stats {
 			_, err := db.Exec(stat)
@@ -1388,53 +2256,63 @@ func main() {
 				os.Exit(-1)
 			}
 		}
-	} else {
-		for {
-			bytes, err := ioutil.ReadFile(fmt.Sprintf("schemas/upgrade-%d.sql", version))
-			if err != nil {
-				break
-			}
-			stats := strings.Split(string(bytes), ";")
-			for _, stat := range stats {
-				stat = strings.TrimSpace(stat)
-				if len(stat) > 0 {
-					logger.Infof("Executing upgrade SQL: %s", stat)
-					_, err := db.Exec(stat)
-					if err != nil {
-						logger.Fatal(err)
-						os.Exit(-1)
-					}
+		version = 1
+	}
+	for {
+		bytes, err := ioutil.ReadFile(fmt.Sprintf("%s/upgrade-%d.sql", schemaPath, version))
+		if err != nil {
+			break
+		}
+		stats := strings.Split(string(bytes), ";")
+		for _, stat := range stats {
+			stat = strings.TrimSpace(stat)
+			if len(stat) > 0 {
+				logger.Infof("Executing upgrade SQL: %s", stat)
+				_, err := db.Exec(stat)
+				if err != nil {
+					logger.Fatal(err)
+					os.Exit(-1)
 				}
 			}
-			version += 1
 		}
+		version += 1
+	}
+
+	if flag.Arg(0) == "backup" {
+		os.Exit(backupCommand(flag.Args()[1:]))
 	}
 
 	states := make(map[string]state)
-	for state := DELETING; state <= TAG_SUCCESS; state += 1 {
+	for state := DELETING; state <= TRIM_SUCCESS; state += 1 {
 		states[state.String()] = state
 	}
-	rows, err := db.Query(`SELECT id, name, url, user, password, timeout FROM registries`)
-	for rows.Next() {
-		var id int
-		var name string
-		var url string
-		var user string
-		var password string
-		var timeout int
-		rows.Scan(&id, &name, &url, &user, &password, &timeout)
-		registries[id] = &registry{id, name, url, user, password, time.Unix(0, 0), timeout}
-	}
-	rows, err = db.Query(`SELECT id, description, value FROM credentials`)
+	rows, err := db.Query(`SELECT id, description, user, value FROM credentials`)
 	for rows.Next() {
 		var id int
 		var description string
+		var user sql.NullString
 		var value string
-		rows.Scan(&id, &description, &value)
-		cr := &credential{id, description, value}
+		rows.Scan(&id, &description, &user, &value)
+		cr := &credential{id, description, user.String, value}
 		credentials[cr.id] = cr
 	}
-	rows, err = db.Query(`SELECT id, name, labels, source, branch, buildSpec, prepackageSpec, packageSpec, buildHash, state, version, protected, tagRepo FROM projects`)
+	rows, err = db.Query(`SELECT id, name, url, credential, auth, ca, insecure, timeout FROM registries`)
+	for rows.Next() {
+		var id int
+		var name string
+		var url string
+		var crid sql.NullInt64
+		var auth string
+		var ca string
+		var insecure int
+		var timeout int
+		rows.Scan(&id, &name, &url, &crid, &auth, &ca, &insecure, &timeout)
+		r := &registry{id, name, url, credentials[int(crid.Int64)], auth, ca, insecure == 1, time.Unix(0, 0), timeout, ""}
+		registryWriteCA(r)
+		registries[id] = r
+	}
+	rows, err = db.Query(`SELECT id, name, labels, source, branch, buildSpec, prepackageSpec, packageSpec, buildHash, state, version, IFNULL(protected, 0), IFNULL(tagRepo, 0),
+		versioning, versionFile, versionBump, gitTagFormat, pollInterval, quota FROM projects`)
 	for rows.Next() {
 		var id int
 		var name string
@@ -1449,7 +2327,14 @@ func main() {
 		var version int
 		var protected int
 		var tagRepo int
-		err := rows.Scan(&id, &name, &labels, &source, &branch, &buildSpec, &prepackageSpec, &packageSpec, &buildHash, &stateName, &version, &protected, &tagRepo)
+		var versioning string
+		var versionFile string
+		var versionBump string
+		var gitTagFormat string
+		var pollInterval int
+		var quota int64
+		err := rows.Scan(&id, &name, &labels, &source, &branch, &buildSpec, &prepackageSpec, &packageSpec, &buildHash, &stateName, &version, &protected, &tagRepo,
+			&versioning, &versionFile, &versionBump, &gitTagFormat, &pollInterval, &quota)
 		if err != nil {
 			logger.Error(err)
 		}
@@ -1462,14 +2347,19 @@ func main() {
 			make([]trigger, 0),
 			make(map[string]*credential),
 			nil, nil, nil, "",
+			versioning, versionFile, versionBump, gitTagFormat, "", pollInterval, nil, "", quota, nil,
 		}
 		out, err := exec.Command("git", "-C", fmt.Sprintf("%s/%d/workspace/source", projectAbs, p.id), "rev-parse", "HEAD").Output()
 		if err == nil {
 			p.commit = strings.TrimSpace(string(out))
 		}
 		fmt.Printf("%+v\n", p)
+		projectsMutex.Lock()
 		projects[p.id] = p
-		go projectRoutine(p)
+		projectsMutex.Unlock()
+	}
+	for _, p := range snapshotProjects() {
+		p.versionName = projectVersionInfo(p, p.version).name
 	}
 	rows, err = db.Query(`SELECT project, registry, tag FROM destinations`)
 	for rows.Next() {
@@ -1480,7 +2370,7 @@ func main() {
 		if err != nil {
 			logger.Error(err)
 		}
-		p := projects[pid]
+		p := findProject(pid)
 		r := registries[rid]
 		if p != nil && r != nil {
 			p.destinations = append(p.destinations, destination{r, tag})
@@ -1494,7 +2384,7 @@ func main() {
 		var state string
 		var time string
 		rows.Scan(&pid, &id, &kind, &state, &time)
-		p := projects[pid]
+		p := findProject(pid)
 		if p != nil {
 			p.tasks = append(p.tasks, &task{id, kind, state, time})
 			if len(p.tasks) > 5 {
@@ -1502,16 +2392,23 @@ func main() {
 			}
 		}
 	}
-	rows, err = db.Query(`SELECT project, target, state FROM triggers`)
+	rows, err = db.Query(`SELECT project, target, state, event, branches, tags, labels, variables FROM triggers`)
 	for rows.Next() {
 		var pid int
 		var tid int
 		var stateName string
-		rows.Scan(&pid, &tid, &stateName)
-		p := projects[pid]
-		t := projects[tid]
+		var on string
+		var branches string
+		var tags string
+		var labels string
+		var variablesJSON string
+		rows.Scan(&pid, &tid, &stateName, &on, &branches, &tags, &labels, &variablesJSON)
+		p := findProject(pid)
+		t := findProject(tid)
 		if p != nil && t != nil {
-			p.triggers = append(p.triggers, trigger{t, states[stateName]})
+			variables := make(map[string]string)
+			json.Unmarshal([]byte(variablesJSON), &variables)
+			p.triggers = append(p.triggers, trigger{t, states[stateName], on, branches, tags, labels, variables})
 			switch states[stateName] {
 			case PREPARING:
 				t.prepareDep = p
@@ -1522,26 +2419,41 @@ func main() {
 			}
 		}
 	}
+	for _, p := range snapshotProjects() {
+		if cycle := findCycle(triggerEdges(p, p.triggers), p.id); cycle != nil {
+			logger.Warnf("Trigger cycle %s", formatCycle(cycle))
+		}
+	}
 	rows, err = db.Query(`SELECT project, name, credential FROM environments`)
 	for rows.Next() {
 		var pid int
 		var name string
 		var crid int
 		rows.Scan(&pid, &name, &crid)
-		p := projects[pid]
+		p := findProject(pid)
 		cr := credentials[crid]
 		if p != nil && cr != nil {
 			p.credentials[name] = cr
 		}
 	}
+	loadSchedules(states)
+	loadFanIns(states)
 
 	go func() {
 		for {
 			select {
 			case client := <-clients.register:
 				clients.clients[client] = true
+				atomic.StoreInt64(&sseClients, int64(len(clients.clients)))
 			case client := <-clients.unregister:
 				delete(clients.clients, client)
+				atomic.StoreInt64(&sseClients, int64(len(clients.clients)))
+			case <-clients.close:
+				for client := range clients.clients {
+					close(client)
+					delete(clients.clients, client)
+				}
+				atomic.StoreInt64(&sseClients, 0)
 			case event := <-clients.events:
 				for client, _ := range clients.clients {
 					client <- event
@@ -1550,18 +2462,42 @@ func main() {
 		}
 	}()
 
+	switch flag.Arg(0) {
+	case "export":
+		os.Exit(exportCommand(flag.Args()[1:]))
+	case "import":
+		os.Exit(importCommand(flag.Args()[1:]))
+	}
+
+	routinesStarted = true
+	for _, p := range snapshotProjects() {
+		go projectRoutine(p)
+	}
+
 	go func() {
 		for {
 			logger.Info("Pruning images")
-			err := exec.Command("podman", "image", "prune", "-f", "--filter", "until=5m").Run()
+			err := exec.Command("podman", "image", "prune", "-f", "--filter", fmt.Sprintf("until=%s", cfg.Prune.Until)).Run()
 			if err != nil {
 				logger.Error(err)
+				metricImagePrunes.inc("error")
+			} else {
+				metricImagePrunes.inc("success")
 			}
-			time.Sleep(60 * time.Second)
+			time.Sleep(cfg.Prune.Interval.Duration)
 		}
 	}()
 
+	go scheduleRoutine()
+	go pollRoutine()
+	go usageRoutine()
+
 	handlers["/events"] = handleEvents
+	handlers["/metrics"] = handleMetrics
+	handlers["/healthz"] = handleHealthz
+	handlers["/readyz"] = handleReadyz
+	handlers["/server/drain"] = handleServerDrain
+	handlers["/server/backup"] = handleServerBackup
 	handlers["/user/current"] = handleUserCurrent
 	handlers["/user/login"] = handleUserLogin
 	handlers["/user/logout"] = handleUserLogout
@@ -1572,26 +2508,56 @@ func main() {
 	handlers["/project/triggers"] = handleProjectTriggers
 	handlers["/project/environment"] = handleProjectEnvironment
 	handlers["/project/create"] = handleProjectCreate
+	handlers["/project/clone"] = handleProjectClone
 	handlers["/project/upload"] = handleProjectUpload
+	handlers["/project/files"] = handleProjectFiles
+	handlers["/project/files/download"] = handleProjectFilesDownload
+	handlers["/project/files/delete"] = handleProjectFilesDelete
 	handlers["/project/build"] = handleProjectBuild
 	handlers["/project/delete"] = handleProjectDelete
+	handlers["/project/digests"] = handleProjectDigests
+	handlers["/project/promote"] = handleProjectPromote
+	handlers["/project/rollback"] = handleProjectRollback
+	handlers["/project/images"] = handleProjectImages
+	handlers["/project/bump"] = handleProjectBump
+	handlers["/project/versions"] = handleProjectVersions
+	handlers["/project/revisions"] = handleProjectRevisions
+	handlers["/project/diff"] = handleProjectDiff
+	handlers["/project/restore"] = handleProjectRestore
+	handlers["/project/graph"] = handleProjectGraph
+	handlers["/project/join"] = handleProjectJoin
+	handlers["/project/export"] = handleProjectExport
+	handlers["/project/import"] = handleProjectImport
+	handlers["/schedule/list"] = handleScheduleList
+	handlers["/schedule/create"] = handleScheduleCreate
+	handlers["/schedule/update"] = handleScheduleUpdate
+	handlers["/schedule/delete"] = handleScheduleDelete
 	handlers["/task/list"] = handleTaskList
 	handlers["/task/logs"] = handleTaskLogs
 	handlers["/registry/list"] = handleRegistryList
 	handlers["/registry/create"] = handleRegistryCreate
 	handlers["/registry/update"] = handleRegistryUpdate
+	handlers["/registry/delete"] = handleRegistryDelete
+	handlers["/registry/test"] = handleRegistryTest
 	handlers["/credential/list"] = handleCredentialList
 	handlers["/credential/create"] = handleCredentialCreate
 	handlers["/credential/update"] = handleCredentialUpdate
 	handlers["/credential/delete"] = handleCredentialDelete
 
 	http.HandleFunc("/", handleRoot)
-	endpoint := fmt.Sprintf(":%d", port)
-	if len(sslCert) > 0 {
-		logger.Infof("Listening on https://0.0.0.0:%d", port)
-		logger.Fatal(http.ListenAndServeTLS(endpoint, sslCert, sslKey, nil))
+	server := &http.Server{Addr: fmt.Sprintf(":%d", cfg.Port)}
+	finished := make(chan bool)
+	go handleSignals(server, finished)
+	if len(cfg.SSLCert) > 0 {
+		logger.Infof("Listening on https://0.0.0.0:%d", cfg.Port)
+		err = server.ListenAndServeTLS(cfg.SSLCert, cfg.SSLKey)
 	} else {
-		logger.Infof("Listening on http://0.0.0.0:%d", port)
-		logger.Fatal(http.ListenAndServe(endpoint, nil))
+		logger.Infof("Listening on http://0.0.0.0:%d", cfg.Port)
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		logger.Fatal(err)
 	}
+	<-finished
+	logger.Info("Shutdown complete")
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func registryClient(r *registry) *http.Client {
+	config := &tls.Config{InsecureSkipVerify: r.insecure}
+	if r.ca != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pool.AppendCertsFromPEM([]byte(r.ca))
+		config.RootCAs = pool
+	}
+	return &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: config},
+	}
+}
+
+func registryBase(address string) (string, error) {
+	if !strings.Contains(address, "://") {
+		address = "https://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("Invalid registry URL %s", address)
+	}
+	return fmt.Sprintf("%s://%s/v2/", u.Scheme, u.Host), nil
+}
+
+func parseChallenge(header string) (string, map[string]string) {
+	scheme := header
+	params := make(map[string]string)
+	if i := strings.Index(header, " "); i >= 0 {
+		scheme = header[:i]
+		for _, part := range strings.Split(header[i+1:], ",") {
+			kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+			if len(kv) == 2 {
+				params[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+			}
+		}
+	}
+	return strings.ToLower(scheme), params
+}
+
+func registryToken(client *http.Client, challenge map[string]string, user, password string) (string, error) {
+	realm, err := url.Parse(challenge["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("Invalid token realm %q", challenge["realm"])
+	}
+	query := realm.Query()
+	if challenge["service"] != "" {
+		query.Set("service", challenge["service"])
+	}
+	if challenge["scope"] != "" {
+		query.Set("scope", challenge["scope"])
+	}
+	realm.RawQuery = query.Encode()
+	req, _ := http.NewRequest("GET", realm.String(), nil)
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("Token request returned %s", resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return "", err
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	if token.AccessToken != "" {
+		return token.AccessToken, nil
+	}
+	return "", errors.New("Token response did not contain a token")
+}
+
+func registryCheck(r *registry) error {
+	base, err := registryBase(r.url)
+	if err != nil {
+		return err
+	}
+	client := registryClient(r)
+	resp, err := client.Get(base)
+	if err != nil && r.insecure && !strings.Contains(r.url, "://") {
+		base = "http" + strings.TrimPrefix(base, "https")
+		resp, err = client.Get(base)
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == 200 && r.credential == nil {
+		return nil
+	}
+	if resp.StatusCode != 200 && resp.StatusCode != 401 {
+		return fmt.Errorf("Registry returned %s", resp.Status)
+	}
+	if r.credential == nil {
+		return errors.New("Registry requires authentication but no credential is set")
+	}
+	req, _ := http.NewRequest("GET", base, nil)
+	scheme, challenge := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	switch {
+	case r.auth == "token" && (scheme != "bearer" || r.credential.user == ""):
+		req.Header.Set("Authorization", "Bearer "+r.credential.value)
+	case scheme == "bearer":
+		token, err := registryToken(client, challenge, registryUser(r), r.credential.value)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case scheme == "basic" || scheme == "":
+		req.SetBasicAuth(registryUser(r), r.credential.value)
+	default:
+		return fmt.Errorf("Unsupported authentication scheme %s", scheme)
+	}
+	resp, err = client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Registry returned %s", resp.Status)
+	}
+	return nil
+}
+
+func handleRegistryTest(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/registry/test", params) {
+		return
+	}
+	var reg *registry
+	if params["id"] != "" {
+		id, _ := strconv.Atoi(params["id"])
+		reg = registries[id]
+		if reg == nil {
+			w.WriteHeader(404)
+			w.Write([]byte("Registry not found"))
+			return
+		}
+	} else {
+		crid, _ := strconv.Atoi(params["credential"])
+		insecure, _ := strconv.ParseBool(params["insecure"])
+		reg = &registry{
+			url:        params["url"],
+			credential: credentials[crid],
+			auth:       params["auth"],
+			ca:         params["ca"],
+			insecure:   insecure,
+		}
+	}
+	result := map[string]interface{}{
+		"ok": true,
+	}
+	err := registryCheck(reg)
+	if err != nil {
+		logger.Warnf("Registry test %s failed: %v", reg.url, err)
+		result["ok"] = false
+		result["error"] = err.Error()
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
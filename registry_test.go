@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryCheckOpen(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/" {
+			w.WriteHeader(404)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+	err := registryCheck(&registry{url: server.URL})
+	if err != nil {
+		t.Fatalf("Expected success, got %v", err)
+	}
+}
+
+func basicRegistry(user, password string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/" {
+			w.WriteHeader(404)
+			return
+		}
+		u, p, ok := r.BasicAuth()
+		if !ok || u != user || p != password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(401)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+}
+
+func TestRegistryCheckBasic(t *testing.T) {
+	server := basicRegistry("builder", "secret")
+	defer server.Close()
+	reg := &registry{url: server.URL, auth: "basic", credential: &credential{user: "builder", value: "secret"}}
+	err := registryCheck(reg)
+	if err != nil {
+		t.Fatalf("Expected success, got %v", err)
+	}
+	reg.credential = nil
+	err = registryCheck(reg)
+	if err == nil {
+		t.Fatal("Expected an error without a credential")
+	}
+}
+
+func TestRegistryCheckWrongPassword(t *testing.T) {
+	server := basicRegistry("builder", "secret")
+	defer server.Close()
+	reg := &registry{url: server.URL, auth: "basic", credential: &credential{user: "builder", value: "wrong"}}
+	err := registryCheck(reg)
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("Expected a 401 error, got %v", err)
+	}
+}
+
+func TestRegistryCheckBearer(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			u, p, ok := r.BasicAuth()
+			if !ok || u != "builder" || p != "secret" || r.URL.Query().Get("service") != "registry.test" {
+				w.WriteHeader(401)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"token": "abc123"}`))
+		case "/v2/":
+			if r.Header.Get("Authorization") != "Bearer abc123" {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry.test"`, server.URL))
+				w.WriteHeader(401)
+				return
+			}
+			w.WriteHeader(200)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+	reg := &registry{url: server.URL, auth: "basic", credential: &credential{user: "builder", value: "secret"}}
+	err := registryCheck(reg)
+	if err != nil {
+		t.Fatalf("Expected success, got %v", err)
+	}
+	reg.credential = &credential{user: "builder", value: "wrong"}
+	err = registryCheck(reg)
+	if err == nil || !strings.Contains(err.Error(), "Token request") {
+		t.Fatalf("Expected a token request error, got %v", err)
+	}
+}
+
+func TestRegistryCheckInsecureFallback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/" {
+			w.WriteHeader(404)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+	err := registryCheck(&registry{url: address})
+	if err == nil {
+		t.Fatal("Expected an error contacting a plain http registry over https")
+	}
+	err = registryCheck(&registry{url: address, insecure: true})
+	if err != nil {
+		t.Fatalf("Expected success falling back to http, got %v", err)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type revision struct {
+	id      int
+	project int
+	path    string
+	hash    string
+	author  string
+	time    string
+}
+
+// Paths are kept relative to the project directory with a leading slash, e.g. /BuildSpec.
+func revisionPath(name string) string {
+	return filepath.Clean("/" + name)
+}
+
+// Stores content as a new revision of path, unless it is the same as the latest revision.
+func projectRecordRevision(p *project, name string, content []byte, author string) (int, error) {
+	path := revisionPath(name)
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	var id int
+	var latest string
+	err := db.QueryRow(`SELECT id, hash FROM revisions WHERE project = ? AND path = ? ORDER BY id DESC LIMIT 1`, p.id, path).Scan(&id, &latest)
+	if err == nil && latest == hash {
+		return id, nil
+	}
+	_, err = db.Exec(`INSERT OR IGNORE INTO blobs(hash, content) VALUES(?, ?)`, hash, content)
+	if err != nil {
+		return 0, err
+	}
+	err = db.QueryRow(`INSERT INTO revisions(project, path, hash, author, time) VALUES(?, ?, ?, ?, datetime('now')) RETURNING id`,
+		p.id, path, hash, author).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	logger.Infof("Project %d revision %d of %s by %s", p.id, id, path, author)
+	return id, nil
+}
+
+func projectRevision(p *project, id int) (*revision, []byte, error) {
+	r := &revision{}
+	var content []byte
+	err := db.QueryRow(`SELECT revisions.id, project, path, revisions.hash, author, time, content FROM revisions
+		JOIN blobs ON blobs.hash = revisions.hash WHERE revisions.id = ? AND project = ?`, id, p.id).Scan(
+		&r.id, &r.project, &r.path, &r.hash, &r.author, &r.time, &content)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Revision %d not found", id)
+	}
+	return r, content, nil
+}
+
+// The revision paths of the project's spec files. Specs under /workspace come from git and are covered by the commit.
+func projectSpecPaths(p *project) []string {
+	paths := make([]string, 0)
+	for _, spec := range []string{p.buildSpec, p.prepackageSpec, p.packageSpec} {
+		if spec == "" {
+			continue
+		}
+		path := revisionPath(spec)
+		if path == "/workspace" || strings.HasPrefix(path, "/workspace/") {
+			continue
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// Records the spec files as they are now, for changes made other than by uploading them one at a time.
+func projectRecordSpecFiles(p *project, author string) {
+	for _, path := range projectSpecPaths(p) {
+		content, err := ioutil.ReadFile(fmt.Sprintf("%s/%d%s", projectAbs, p.id, path))
+		if err != nil {
+			continue
+		}
+		_, err = projectRecordRevision(p, path, content, author)
+		if err != nil {
+			logger.Error(err)
+		}
+	}
+}
+
+// Records the revisions of the spec files a build used.
+func projectRecordSpecs(p *project, version int) {
+	for _, path := range projectSpecPaths(p) {
+		content, err := ioutil.ReadFile(fmt.Sprintf("%s/%d%s", projectAbs, p.id, path))
+		if err != nil {
+			logger.Warn(err)
+			continue
+		}
+		id, err := projectRecordRevision(p, path, content, "racs")
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+		db.Exec(`INSERT OR REPLACE INTO versionSpecs(project, version, path, revision) VALUES(?, ?, ?, ?)`, p.id, version, path, id)
+	}
+}
+
+func projectDeleteRevisions(p *project) {
+	db.Exec(`DELETE FROM revisions WHERE project = ?`, p.id)
+	db.Exec(`DELETE FROM versionSpecs WHERE project = ?`, p.id)
+	db.Exec(`DELETE FROM blobs WHERE hash NOT IN (SELECT hash FROM revisions)`)
+}
+
+// The spec revisions recorded for each version of the project.
+func projectVersionSpecs(p *project) map[int]map[string]int {
+	result := make(map[int]map[string]int)
+	rows, err := db.Query(`SELECT version, path, revision FROM versionSpecs WHERE project = ?`, p.id)
+	if err != nil {
+		return result
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version, revision int
+		var path string
+		rows.Scan(&version, &path, &revision)
+		if result[version] == nil {
+			result[version] = make(map[string]int)
+		}
+		result[version][path] = revision
+	}
+	return result
+}
+
+func handleProjectRevisions(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/revisions", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := findProject(id)
+	if p == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Project not found"))
+		return
+	}
+	query := `SELECT revisions.id, path, revisions.hash, length(content), author, time FROM revisions
+		JOIN blobs ON blobs.hash = revisions.hash WHERE project = ?`
+	args := []interface{}{p.id}
+	if params["path"] != "" {
+		query += ` AND path = ?`
+		args = append(args, revisionPath(params["path"]))
+	}
+	result := make([]map[string]interface{}, 0)
+	rows, err := db.Query(query+` ORDER BY revisions.id DESC`, args...)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var revision, size int
+			var path, hash, author, time string
+			rows.Scan(&revision, &path, &hash, &size, &author, &time)
+			result = append(result, map[string]interface{}{
+				"revision": revision,
+				"path":     path,
+				"hash":     hash,
+				"size":     size,
+				"author":   author,
+				"time":     time,
+			})
+		}
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
+
+func revisionDiff(from, to *revision, fromContent, toContent []byte) ([]byte, error) {
+	files := make([]string, 0)
+	defer func() {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	for _, content := range [][]byte{fromContent, toContent} {
+		temp, err := ioutil.TempFile(uploadAbs, "diff-")
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, temp.Name())
+		temp.Write(content)
+		temp.Close()
+	}
+	out, err := exec.Command("diff", "-u",
+		"--label", fmt.Sprintf("%s@%d", from.path, from.id), "--label", fmt.Sprintf("%s@%d", to.path, to.id),
+		files[0], files[1]).Output()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == 1 {
+		err = nil
+	}
+	return out, err
+}
+
+func handleProjectDiff(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/diff", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := findProject(id)
+	if p == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Project not found"))
+		return
+	}
+	fromID, _ := strconv.Atoi(params["from"])
+	toID, _ := strconv.Atoi(params["to"])
+	from, fromContent, err := projectRevision(p, fromID)
+	if err != nil {
+		w.WriteHeader(404)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	to, toContent, err := projectRevision(p, toID)
+	if err != nil {
+		w.WriteHeader(404)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	diff, err := revisionDiff(from, to, fromContent, toContent)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Add("Content-Type", "text/plain")
+	w.Write(diff)
+}
+
+func handleProjectRestore(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/restore", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := findProject(id)
+	if p == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Project not found"))
+		return
+	}
+	revisionID, _ := strconv.Atoi(params["revision"])
+	revision, content, err := projectRevision(p, revisionID)
+	if err != nil {
+		w.WriteHeader(404)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	filename := fmt.Sprintf("%s/%d%s", projectAbs, p.id, revision.path)
+	os.MkdirAll(filepath.Dir(filename), 0777)
+	err = ioutil.WriteFile(filename, content, 0666)
+	if err == nil {
+		_, err = projectRecordRevision(p, revision.path, content, u.Name)
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
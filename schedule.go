@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type schedule struct {
+	id      int
+	project *project
+	spec    string
+	cron    *cronSpec
+	stage   state
+	enabled bool
+	next    time.Time
+}
+
+var schedules = map[int]*schedule{}
+var scheduleMutex sync.Mutex
+
+var stageNames = map[string]state{
+	"clean":      CLEANING,
+	"clone":      CLONING,
+	"prepare":    PREPARING,
+	"pull":       PULLING,
+	"build":      BUILDING,
+	"prepackage": PREPACKAGING,
+	"package":    PACKAGING,
+	"push":       PUSHING,
+	"tag":        TAGGING,
+}
+
+func loadSchedules(states map[string]state) {
+	rows, err := db.Query(`SELECT id, project, spec, stage, enabled FROM schedules`)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var pid int
+		var spec string
+		var stage string
+		var enabled int
+		rows.Scan(&id, &pid, &spec, &stage, &enabled)
+		p := findProject(pid)
+		if p == nil {
+			logger.Warnf("Skipping schedule %d: project %d not found", id, pid)
+			continue
+		}
+		c, err := parseCron(spec)
+		if err != nil {
+			logger.Warnf("Skipping schedule %d: %v", id, err)
+			continue
+		}
+		s := &schedule{id, p, spec, c, states[stage], enabled == 1, time.Time{}}
+		if s.enabled {
+			s.next = c.next(time.Now())
+		}
+		schedules[id] = s
+	}
+}
+
+func scheduleJSON(s *schedule) map[string]interface{} {
+	result := map[string]interface{}{
+		"id":      s.id,
+		"project": s.project.id,
+		"spec":    s.spec,
+		"stage":   s.stage.String(),
+		"enabled": s.enabled,
+	}
+	if !s.next.IsZero() {
+		result["next"] = s.next.Format(time.RFC3339)
+	}
+	return result
+}
+
+func scheduleEvent(name string, s *schedule) {
+	e := scheduleJSON(s)
+	e["event"] = name
+	event(e)
+}
+
+func scheduleDeleteProject(p *project) {
+	scheduleMutex.Lock()
+	defer scheduleMutex.Unlock()
+	for id, s := range schedules {
+		if s.project == p {
+			delete(schedules, id)
+		}
+	}
+	db.Exec(`DELETE FROM schedules WHERE project = ?`, p.id)
+}
+
+func scheduleRoutine() {
+	for {
+		now := time.Now()
+		scheduleMutex.Lock()
+		for _, s := range schedules {
+			if !s.enabled || s.next.IsZero() || s.next.After(now) {
+				continue
+			}
+			logger.Infof("Project %d scheduled build from %s (%s)", s.project.id, s.stage.String(), s.spec)
+			go s.project.buildFrom(s.stage, defaultRequest)
+			s.next = s.cron.next(now)
+		}
+		scheduleMutex.Unlock()
+		time.Sleep(time.Until(now.Truncate(time.Minute).Add(time.Minute)))
+	}
+}
+
+// Parses the spec, stage and enabled params shared by create and update.
+func scheduleParams(w http.ResponseWriter, params map[string]string) (*cronSpec, state, bool, bool) {
+	c, err := parseCron(params["spec"])
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return nil, NONE, false, false
+	}
+	stage, ok := stageNames[params["stage"]]
+	if !ok {
+		w.WriteHeader(400)
+		w.Write([]byte("Invalid stage"))
+		return nil, NONE, false, false
+	}
+	enabled := true
+	if params["enabled"] != "" {
+		enabled, err = strconv.ParseBool(params["enabled"])
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("Invalid enabled"))
+			return nil, NONE, false, false
+		}
+	}
+	return c, stage, enabled, true
+}
+
+func handleScheduleList(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	pid, _ := strconv.Atoi(params["project"])
+	result := make([]map[string]interface{}, 0)
+	scheduleMutex.Lock()
+	for _, s := range schedules {
+		if pid == 0 || s.project.id == pid {
+			result = append(result, scheduleJSON(s))
+		}
+	}
+	scheduleMutex.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		return result[i]["id"].(int) < result[j]["id"].(int)
+	})
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
+
+func scheduleCreate(p *project, spec string, c *cronSpec, stage state, enabled bool) *schedule {
+	var id int
+	db.QueryRow(`INSERT INTO schedules(project, spec, stage, enabled) VALUES(?, ?, ?, ?) RETURNING id`,
+		p.id, spec, stage.String(), enabled).Scan(&id)
+	s := &schedule{id, p, spec, c, stage, enabled, time.Time{}}
+	if enabled {
+		s.next = c.next(time.Now())
+	}
+	scheduleMutex.Lock()
+	schedules[id] = s
+	scheduleMutex.Unlock()
+	logger.Infof("Schedule created %d project %d %s %s", id, p.id, spec, stage.String())
+	scheduleEvent("schedule/create", s)
+	return s
+}
+
+func handleScheduleCreate(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/schedule/create", params) {
+		return
+	}
+	pid, _ := strconv.Atoi(params["project"])
+	p := findProject(pid)
+	if p == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Project not found"))
+		return
+	}
+	c, stage, enabled, ok := scheduleParams(w, params)
+	if !ok {
+		return
+	}
+	s := scheduleCreate(p, params["spec"], c, stage, enabled)
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(201)
+		w.Write([]byte(strconv.Itoa(s.id)))
+	}
+}
+
+func handleScheduleUpdate(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/schedule/update", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	scheduleMutex.Lock()
+	s := schedules[id]
+	scheduleMutex.Unlock()
+	if s == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Schedule not found"))
+		return
+	}
+	c, stage, enabled, ok := scheduleParams(w, params)
+	if !ok {
+		return
+	}
+	scheduleMutex.Lock()
+	s.spec = params["spec"]
+	s.cron = c
+	s.stage = stage
+	s.enabled = enabled
+	s.next = time.Time{}
+	if s.enabled {
+		s.next = c.next(time.Now())
+	}
+	scheduleMutex.Unlock()
+	db.Exec(`UPDATE schedules SET spec = ?, stage = ?, enabled = ? WHERE id = ?`, s.spec, stage.String(), s.enabled, s.id)
+	scheduleEvent("schedule/update", s)
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
+
+func handleScheduleDelete(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/schedule/delete", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	scheduleMutex.Lock()
+	s := schedules[id]
+	delete(schedules, id)
+	scheduleMutex.Unlock()
+	if s == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Schedule not found"))
+		return
+	}
+	db.Exec(`DELETE FROM schedules WHERE id = ?`, id)
+	event(map[string]interface{}{
+		"event": "schedule/delete",
+		"id":    id,
+	})
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
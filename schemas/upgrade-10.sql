@@ -0,0 +1,3 @@
+ALTER TABLE projects ADD COLUMN quota INTEGER DEFAULT 0;
+
+UPDATE config SET value = 11 WHERE name = 'version';
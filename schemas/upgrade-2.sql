@@ -0,0 +1,27 @@
+ALTER TABLE credentials ADD COLUMN user STRING DEFAULT '';
+
+ALTER TABLE registries ADD COLUMN credential INTEGER DEFAULT 0;
+ALTER TABLE registries ADD COLUMN auth STRING DEFAULT 'basic';
+ALTER TABLE registries ADD COLUMN ca STRING DEFAULT '';
+ALTER TABLE registries ADD COLUMN insecure INTEGER DEFAULT 0;
+
+INSERT INTO credentials(description, user, value) SELECT
+	'Registry ' || name, user, password
+FROM
+	registries
+WHERE
+	user != '';
+
+UPDATE registries SET credential = (
+	SELECT
+		MAX(c.id)
+	FROM
+		credentials c
+	WHERE
+		c.description = 'Registry ' || registries.name AND c.user = registries.user
+) WHERE user != '';
+
+ALTER TABLE registries DROP COLUMN user;
+ALTER TABLE registries DROP COLUMN password;
+
+UPDATE config SET value = 3 WHERE name = 'version';
@@ -0,0 +1,11 @@
+CREATE TABLE digests(
+	project INTEGER,
+	version INTEGER,
+	registry INTEGER,
+	image STRING,
+	digest STRING,
+	time STRING,
+	PRIMARY KEY(project, version, image)
+);
+
+UPDATE config SET value = 4 WHERE name = 'version';
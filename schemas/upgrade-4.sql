@@ -0,0 +1,16 @@
+ALTER TABLE projects ADD COLUMN versioning STRING DEFAULT 'counter';
+ALTER TABLE projects ADD COLUMN versionFile STRING DEFAULT 'VERSION';
+ALTER TABLE projects ADD COLUMN versionBump STRING DEFAULT '';
+ALTER TABLE projects ADD COLUMN gitTagFormat STRING DEFAULT 'r$BUILD';
+
+CREATE TABLE versions(
+	project INTEGER,
+	version INTEGER,
+	name STRING,
+	gitTag STRING,
+	commitHash STRING,
+	time STRING,
+	PRIMARY KEY(project, version)
+);
+
+UPDATE config SET value = 5 WHERE name = 'version';
@@ -0,0 +1,9 @@
+CREATE TABLE schedules(
+	id INTEGER PRIMARY KEY,
+	project INTEGER,
+	spec STRING,
+	stage STRING,
+	enabled INTEGER
+);
+
+UPDATE config SET value = 6 WHERE name = 'version';
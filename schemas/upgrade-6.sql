@@ -0,0 +1,3 @@
+ALTER TABLE projects ADD COLUMN pollInterval INTEGER DEFAULT 0;
+
+UPDATE config SET value = 7 WHERE name = 'version';
@@ -0,0 +1,7 @@
+ALTER TABLE triggers ADD COLUMN event STRING DEFAULT 'success';
+ALTER TABLE triggers ADD COLUMN branches STRING DEFAULT '';
+ALTER TABLE triggers ADD COLUMN tags STRING DEFAULT '';
+ALTER TABLE triggers ADD COLUMN labels STRING DEFAULT '';
+ALTER TABLE triggers ADD COLUMN variables STRING DEFAULT '{}';
+
+UPDATE config SET value = 8 WHERE name = 'version';
@@ -0,0 +1,8 @@
+CREATE TABLE joins(
+	project INTEGER PRIMARY KEY,
+	upstreams STRING,
+	within INTEGER,
+	stage STRING
+);
+
+UPDATE config SET value = 9 WHERE name = 'version';
@@ -0,0 +1,23 @@
+CREATE TABLE blobs(
+	hash STRING PRIMARY KEY,
+	content BLOB
+);
+
+CREATE TABLE revisions(
+	id INTEGER PRIMARY KEY,
+	project INTEGER,
+	path STRING,
+	hash STRING,
+	author STRING,
+	time STRING
+);
+
+CREATE TABLE versionSpecs(
+	project INTEGER,
+	version INTEGER,
+	path STRING,
+	revision INTEGER,
+	PRIMARY KEY(project, version, path)
+);
+
+UPDATE config SET value = 10 WHERE name = 'version';
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var draining int32
+var errDraining = errors.New("Draining")
+var shuttingDown bool
+var taskMutex sync.Mutex
+var runningTasks sync.WaitGroup
+var taskContext, cancelTasks = context.WithCancel(context.Background())
+
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+func setDraining(enabled bool) {
+	value := int32(0)
+	if enabled {
+		value = 1
+	}
+	if atomic.SwapInt32(&draining, value) != value {
+		logger.Infof("Drain mode %t", enabled)
+		event(map[string]interface{}{
+			"event":    "server/drain",
+			"draining": enabled,
+		})
+	}
+}
+
+func beginTask() bool {
+	taskMutex.Lock()
+	defer taskMutex.Unlock()
+	if shuttingDown {
+		return false
+	}
+	runningTasks.Add(1)
+	return true
+}
+
+func endTask() {
+	runningTasks.Done()
+}
+
+func handleServerDrain(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/server/drain", params) {
+		return
+	}
+	switch params["enabled"] {
+	case "true", "1", "on":
+		setDraining(true)
+	case "false", "0", "off":
+		setDraining(false)
+	}
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.Header().Add("Content-Type", "application/json")
+		j, _ := json.Marshal(map[string]interface{}{
+			"draining": isDraining(),
+		})
+		w.Write(j)
+	}
+}
+
+func shutdown(server *http.Server) {
+	setDraining(true)
+	taskMutex.Lock()
+	shuttingDown = true
+	taskMutex.Unlock()
+	clients.close <- true
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		logger.Error(err)
+	}
+	done := make(chan bool)
+	go func() {
+		runningTasks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(cfg.Shutdown.Grace.Duration):
+		logger.Warnf("Tasks still running after %s, cancelling", cfg.Shutdown.Grace)
+		cancelTasks()
+		<-done
+	}
+	logger.Info("All tasks finished")
+}
+
+func handleSignals(server *http.Server, finished chan bool) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	s := <-signals
+	logger.Infof("Received %s, shutting down", s)
+	shutdown(server)
+	close(finished)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type pushTarget struct {
+	registry *registry
+	image    string
+}
+
+func tagVariables(p *project, version int, trigger *taskTrigger) map[string]string {
+	commit := p.commit
+	name := strconv.Itoa(version)
+	if version != p.version {
+		info := projectVersionInfo(p, version)
+		name = info.name
+		commit = info.commit
+		if commit == "" {
+			out, err := exec.Command("git", "-C", fmt.Sprintf("%s/%d/workspace/source", projectAbs, p.id), "rev-parse", info.gitTag+"^{commit}").Output()
+			if err == nil {
+				commit = strings.TrimSpace(string(out))
+			}
+		}
+	} else if p.versionName != "" {
+		name = p.versionName
+	}
+	shortCommit := commit
+	if len(shortCommit) > 7 {
+		shortCommit = shortCommit[:7]
+	}
+	vars := map[string]string{
+		"VERSION":          name,
+		"BUILD":            strconv.Itoa(version),
+		"COMMIT":           commit,
+		"SHORT_COMMIT":     shortCommit,
+		"BRANCH":           p.branch,
+		"DATE":             time.Now().UTC().Format("20060102"),
+		"TRIGGER_URL":      "",
+		"TRIGGER_BRANCH":   "",
+		"TRIGGER_COMMIT":   "",
+		"TRIGGER_TAG":      "",
+		"TRIGGER_REGISTRY": "",
+		"TRIGGER_PROJECT":  "",
+		"TRIGGER_VERSION":  "",
+		"UPSTREAM_VERSION": "",
+	}
+	if trigger != nil {
+		vars["TRIGGER_URL"] = trigger.url
+		vars["TRIGGER_BRANCH"] = trigger.branch
+		vars["TRIGGER_COMMIT"] = trigger.commit
+		vars["TRIGGER_TAG"] = trigger.tag
+		vars["TRIGGER_REGISTRY"] = trigger.registry
+		vars["TRIGGER_PROJECT"] = strconv.Itoa(trigger.project)
+		vars["TRIGGER_VERSION"] = strconv.Itoa(trigger.version)
+		vars["UPSTREAM_VERSION"] = strconv.Itoa(trigger.version)
+		if upstream := findProject(trigger.project); upstream != nil {
+			vars["UPSTREAM_VERSION"] = projectVersionName(upstream, trigger.version)
+		}
+		for name, value := range trigger.variables {
+			vars[name] = value
+		}
+		for id, version := range trigger.upstreams {
+			if upstream := findProject(id); upstream != nil {
+				vars[fmt.Sprintf("UPSTREAM_%d_VERSION", id)] = projectVersionName(upstream, version)
+			} else {
+				vars[fmt.Sprintf("UPSTREAM_%d_VERSION", id)] = strconv.Itoa(version)
+			}
+		}
+	}
+	return vars
+}
+
+// Expands the variables in template, returning an error naming any that are not set.
+func expandTag(template string, vars map[string]string) (string, error) {
+	unknown := make([]string, 0)
+	result := os.Expand(template, func(name string) string {
+		value, ok := vars[name]
+		if !ok {
+			unknown = append(unknown, "$"+name)
+		}
+		return value
+	})
+	if len(unknown) > 0 {
+		return result, fmt.Errorf("Unknown tag variable %s in %s", strings.Join(unknown, ", "), template)
+	}
+	return result, nil
+}
+
+// A destination tag may list several space separated tags, e.g. "app:$VERSION app:latest".
+func pushTargets(p *project, version int, destinations []destination, trigger *taskTrigger) ([]pushTarget, error) {
+	vars := tagVariables(p, version, trigger)
+	targets := make([]pushTarget, 0)
+	for _, destination := range destinations {
+		for _, tag := range strings.Fields(destination.tag) {
+			image, err := expandTag(tag, vars)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, pushTarget{destination.registry, image})
+		}
+	}
+	return targets, nil
+}
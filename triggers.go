@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type triggerSpec struct {
+	Target    int               `json:"target"`
+	Stage     string            `json:"stage"`
+	On        string            `json:"on"`
+	Branches  string            `json:"branches"`
+	Tags      string            `json:"tags"`
+	Labels    string            `json:"labels"`
+	Variables map[string]string `json:"variables"`
+}
+
+var variableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Parses either the JSON list of trigger specs or the plain target,stage,target,stage form.
+func parseTriggerSpecs(value string) ([]triggerSpec, error) {
+	specs := make([]triggerSpec, 0)
+	if strings.HasPrefix(strings.TrimSpace(value), "[") {
+		err := json.Unmarshal([]byte(value), &specs)
+		return specs, err
+	}
+	fields := strings.FieldsFunc(value, func(c rune) bool {
+		return c == ','
+	})
+	for i := 0; i+1 < len(fields); i += 2 {
+		var target int
+		_, err := fmt.Sscanf(fields[i], "%d", &target)
+		if err != nil {
+			return nil, fmt.Errorf("Project %s not found", fields[i])
+		}
+		specs = append(specs, triggerSpec{Target: target, Stage: fields[i+1]})
+	}
+	return specs, nil
+}
+
+func (spec triggerSpec) trigger() (trigger, error) {
+	t := findProject(spec.Target)
+	if t == nil {
+		return trigger{}, fmt.Errorf("Project %d not found", spec.Target)
+	}
+	return spec.triggerTo(t)
+}
+
+// Checks the stage and conditions and returns the trigger building project t, which may be nil to only check them.
+func (spec triggerSpec) triggerTo(t *project) (trigger, error) {
+	s, ok := stageNames[spec.Stage]
+	if !ok && spec.Stage != "none" {
+		return trigger{}, fmt.Errorf("Invalid stage %s", spec.Stage)
+	}
+	if !ok {
+		s = NONE
+	}
+	switch spec.On {
+	case "":
+		spec.On = "success"
+	case "success", "failure", "always":
+	default:
+		return trigger{}, fmt.Errorf("Invalid trigger event %s", spec.On)
+	}
+	for _, pattern := range strings.Fields(spec.Branches + " " + spec.Tags) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return trigger{}, fmt.Errorf("Invalid pattern %s", pattern)
+		}
+	}
+	if spec.Variables == nil {
+		spec.Variables = make(map[string]string)
+	}
+	for name, value := range spec.Variables {
+		if !variableName.MatchString(name) {
+			return trigger{}, fmt.Errorf("Invalid variable name %s", name)
+		}
+		// Each variable is a line of the target's environment file
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return trigger{}, fmt.Errorf("Variable %s must not contain line breaks", name)
+		}
+	}
+	return trigger{t, s, spec.On, spec.Branches, spec.Tags, spec.Labels, spec.Variables}, nil
+}
+
+func triggerList(p *project) []interface{} {
+	triggers := make([]interface{}, 0)
+	for _, trigger := range p.triggers {
+		triggers = append(triggers, []interface{}{
+			trigger.project.id, trigger.state.String(), map[string]interface{}{
+				"on":        trigger.on,
+				"branches":  trigger.branches,
+				"tags":      trigger.tags,
+				"labels":    trigger.labels,
+				"variables": trigger.variables,
+			},
+		})
+	}
+	return triggers
+}
+
+func matchPatterns(patterns string, values ...string) bool {
+	if strings.TrimSpace(patterns) == "" {
+		return true
+	}
+	for _, pattern := range strings.Fields(patterns) {
+		for _, value := range values {
+			if ok, _ := path.Match(pattern, value); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hasLabels(labels, required string) bool {
+	have := make(map[string]bool)
+	for _, label := range strings.Split(labels, ",") {
+		have[strings.ToUpper(strings.TrimSpace(label))] = true
+	}
+	for _, label := range strings.Split(required, ",") {
+		label = strings.ToUpper(strings.TrimSpace(label))
+		if label != "" && !have[label] {
+			return false
+		}
+	}
+	return true
+}
+
+// Tag filters match the git tags of the built commit and only apply to successful builds, gitTags is nil for failures.
+func (t trigger) matches(p *project, failed bool, gitTags []string) bool {
+	if failed && t.on == "success" || !failed && t.on == "failure" {
+		return false
+	}
+	if !failed && !matchPatterns(t.tags, gitTags...) {
+		return false
+	}
+	return matchPatterns(t.branches, p.branch) && hasLabels(p.labels, t.labels)
+}
+
+// Fires the project's triggers once per build, after the last push (targets is empty when there are no destinations)
+// or after a failed stage.
+func fireTriggers(p *project, request taskRequest, targets []pushTarget) {
+	failed := p.state%3 == 2
+	tag := ""
+	registry := ""
+	if len(targets) > 0 {
+		tag = targets[0].image
+		registry = targets[0].registry.name
+	}
+	var gitTags []string
+	if !failed {
+		fanInArrive(p, &taskTrigger{p.url, p.branch, p.commit, tag, registry, p.id, p.version, p.state.String(), map[string]string{}, nil})
+		for _, t := range p.triggers {
+			if strings.TrimSpace(t.tags) != "" {
+				gitTags = projectGitTags(p, p.version)
+				break
+			}
+		}
+	}
+	var vars map[string]string
+	for _, t := range p.triggers {
+		if !t.matches(p, failed, gitTags) {
+			continue
+		}
+		if vars == nil {
+			vars = tagVariables(p, p.version, request.trigger)
+		}
+		variables := make(map[string]string)
+		for name, value := range t.variables {
+			expanded, err := expandTag(value, vars)
+			if err != nil {
+				logger.Warnf("Project %d trigger variable %s: %v", p.id, name, err)
+			}
+			variables[name] = expanded
+		}
+		logger.Infof("Project %d %s triggering project %d from %s", p.id, p.state.String(), t.project.id, t.state.String())
+		t.project.buildFrom(t.state, taskRequest{p.state, 0, &taskTrigger{p.url, p.branch, p.commit, tag, registry, p.id, p.version, p.state.String(), variables, nil}, nil})
+	}
+}
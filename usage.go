@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Disk used by a project, in bytes. Images share layers, so their sizes overlap between projects.
+type diskUsage struct {
+	workspace int64
+	context   int64
+	images    int64
+	measured  time.Time
+}
+
+func (u *diskUsage) total() int64 {
+	return u.workspace + u.context + u.images
+}
+
+func usageJSON(p *project) map[string]interface{} {
+	u := p.usage
+	if u == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"workspace": u.workspace,
+		"context":   u.context,
+		"images":    u.images,
+		"total":     u.total(),
+		"measured":  u.measured.UTC().Format("2006-01-02 15:04:05"),
+		"exceeded":  projectQuotaExceeded(p),
+	}
+}
+
+// Sums the blocks allocated to the files below dir, like du.
+func dirUsage(dir string) int64 {
+	var total int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			total += stat.Blocks * 512
+		} else {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+var imageName = regexp.MustCompile(`^(?:.*/)?(?:builder|prepackage|package)-([0-9]+)(?::.*)?$`)
+
+// The size of the builder, prepackage and package images of every project, counting each image once.
+func imageUsage() map[int]int64 {
+	result := make(map[int]int64)
+	out, err := exec.Command("podman", "images", "--format", "json").Output()
+	if err != nil {
+		logger.Error(err)
+		return result
+	}
+	var images []struct {
+		Id    string
+		Size  int64
+		Names []string
+	}
+	err = json.Unmarshal(out, &images)
+	if err != nil {
+		logger.Error(err)
+		return result
+	}
+	for _, image := range images {
+		counted := make(map[int]bool)
+		for _, name := range image.Names {
+			match := imageName.FindStringSubmatch(name)
+			if match == nil {
+				continue
+			}
+			id, _ := strconv.Atoi(match[1])
+			if !counted[id] {
+				counted[id] = true
+				result[id] += image.Size
+			}
+		}
+	}
+	return result
+}
+
+func projectSetUsage(p *project, images int64) {
+	p.usage = &diskUsage{
+		dirUsage(fmt.Sprintf("%s/%d/workspace", projectAbs, p.id)),
+		dirUsage(fmt.Sprintf("%s/%d/context", projectAbs, p.id)),
+		images,
+		time.Now(),
+	}
+	if projectQuotaExceeded(p) {
+		logger.Warnf("Project %d uses %dMB, over its quota of %dMB", p.id, p.usage.total()>>20, p.quota)
+	}
+	event(map[string]interface{}{
+		"event": "project/usage",
+		"id":    p.id,
+		"quota": p.quota,
+		"usage": usageJSON(p),
+	})
+}
+
+func projectMeasureUsage(p *project) {
+	projectSetUsage(p, imageUsage()[p.id])
+}
+
+func measureUsage() {
+	images := imageUsage()
+	for _, p := range snapshotProjects() {
+		projectSetUsage(p, images[p.id])
+	}
+}
+
+func usageRoutine() {
+	for {
+		measureUsage()
+		time.Sleep(cfg.Usage.Interval.Duration)
+	}
+}
+
+// Quotas are in MB, a plain number or one ending in M or G. Empty or 0 means no quota.
+func parseQuota(value string) (int64, error) {
+	number := strings.ToUpper(strings.TrimSpace(value))
+	if number == "" {
+		return 0, nil
+	}
+	scale := int64(1)
+	if strings.HasSuffix(number, "G") || strings.HasSuffix(number, "GB") {
+		scale = 1024
+	}
+	quota, err := strconv.ParseInt(strings.TrimRight(number, "MGB"), 10, 64)
+	if err != nil || quota < 0 {
+		return 0, fmt.Errorf("Invalid quota %q", value)
+	}
+	return quota * scale, nil
+}
+
+func projectQuotaExceeded(p *project) bool {
+	return p.quota > 0 && p.usage != nil && p.usage.total() > p.quota<<20
+}
+
+// Builds are refused while a project is over its quota. Cleaning and trimming free space and are always allowed.
+func projectCheckQuota(p *project, state state) error {
+	if state < CLONING || state > TAGGING || !projectQuotaExceeded(p) {
+		return nil
+	}
+	return fmt.Errorf("using %dMB, over the quota of %dMB", p.usage.total()>>20, p.quota)
+}
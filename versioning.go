@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var versionSchemes = map[string]bool{
+	"counter": true,
+	"semver":  true,
+	"calver":  true,
+	"file":    true,
+}
+
+type projectVersion struct {
+	build  int
+	name   string
+	gitTag string
+	commit string
+}
+
+func projectVersionInfo(p *project, build int) projectVersion {
+	v := projectVersion{build, strconv.Itoa(build), fmt.Sprintf("r%d", build), ""}
+	err := db.QueryRow(`SELECT name, gitTag, commitHash FROM versions WHERE project = ? AND version = ?`, p.id, build).Scan(&v.name, &v.gitTag, &v.commit)
+	if err != nil && build == p.version {
+		v.commit = p.commit
+	}
+	return v
+}
+
+func projectVersionName(p *project, build int) string {
+	if build == p.version && p.versionName != "" {
+		return p.versionName
+	}
+	return projectVersionInfo(p, build).name
+}
+
+// The git tags of the commit a build was made from, starting with the tag racs gave the build.
+func projectGitTags(p *project, build int) []string {
+	info := projectVersionInfo(p, build)
+	tags := []string{info.gitTag}
+	commit := info.commit
+	if commit == "" {
+		commit = "HEAD"
+	}
+	out, err := exec.Command("git", "-C", fmt.Sprintf("%s/%d/workspace/source", projectAbs, p.id), "tag", "--points-at", commit).Output()
+	if err != nil {
+		logger.Warnf("Project %d git tags: %v", p.id, err)
+		return tags
+	}
+	for _, tag := range strings.Fields(string(out)) {
+		if tag != info.gitTag {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// Accepts a build number, optionally prefixed with r, or a version name.
+func parseProjectVersion(p *project, s string) int {
+	var build int
+	err := db.QueryRow(`SELECT MAX(version) FROM versions WHERE project = ? AND name = ?`, p.id, s).Scan(&build)
+	if err == nil && build > 0 {
+		return build
+	}
+	build, _ = strconv.Atoi(strings.TrimPrefix(s, "r"))
+	return build
+}
+
+var semverPattern = regexp.MustCompile(`^v?(\d+)\.(\d+)\.(\d+)`)
+var conventionalPattern = regexp.MustCompile(`^(\w+)(\([^)]*\))?(!)?:`)
+var versionFilePattern = regexp.MustCompile(`^[0-9A-Za-z._+-]{1,128}$`)
+
+func bumpSemver(previous, bump string) string {
+	parts := [3]int{}
+	if m := semverPattern.FindStringSubmatch(previous); m != nil {
+		for i := range parts {
+			parts[i], _ = strconv.Atoi(m[i+1])
+		}
+	}
+	switch bump {
+	case "major":
+		parts = [3]int{parts[0] + 1, 0, 0}
+	case "minor":
+		parts = [3]int{parts[0], parts[1] + 1, 0}
+	default:
+		parts[2] += 1
+	}
+	return fmt.Sprintf("%d.%d.%d", parts[0], parts[1], parts[2])
+}
+
+func conventionalBump(p *project, since string) string {
+	args := []string{"-C", fmt.Sprintf("%s/%d/workspace/source", projectAbs, p.id), "log", "--format=%B%x00"}
+	if since != "" && exec.Command("git", "-C", fmt.Sprintf("%s/%d/workspace/source", projectAbs, p.id), "rev-parse", "-q", "--verify", since).Run() == nil {
+		args = append(args, since+"..HEAD")
+	}
+	out, err := exec.Command("git", args...).Output()
+	if err != nil {
+		logger.Warn(err)
+		return "patch"
+	}
+	bump := "patch"
+	for _, message := range strings.Split(string(out), "\x00") {
+		message = strings.TrimSpace(message)
+		m := conventionalPattern.FindStringSubmatch(message)
+		if (m != nil && m[3] == "!") || strings.Contains(message, "BREAKING CHANGE:") || strings.Contains(message, "BREAKING-CHANGE:") {
+			return "major"
+		}
+		if m != nil && m[1] == "feat" {
+			bump = "minor"
+		}
+	}
+	return bump
+}
+
+func projectNextVersion(p *project) (string, error) {
+	build := p.version + 1
+	switch p.versioning {
+	case "semver":
+		previous := projectVersionInfo(p, p.version)
+		if p.version == 0 {
+			previous = projectVersion{}
+		}
+		bump := p.versionBump
+		if bump == "" {
+			bump = conventionalBump(p, previous.gitTag)
+		}
+		return bumpSemver(previous.name, bump), nil
+	case "calver":
+		date := time.Now().UTC().Format("2006.01.02")
+		previous := projectVersionName(p, p.version)
+		if p.version > 0 && (previous == date || strings.HasPrefix(previous, date+".")) {
+			n, _ := strconv.Atoi(strings.TrimPrefix(previous, date+"."))
+			return fmt.Sprintf("%s.%d", date, n+1), nil
+		}
+		return date, nil
+	case "file":
+		bytes, err := readVersionFile(p)
+		if err != nil {
+			return strconv.Itoa(build), err
+		}
+		name := strings.TrimSpace(string(bytes))
+		if name == "" {
+			return strconv.Itoa(build), fmt.Errorf("Version file %s is empty", p.versionFile)
+		}
+		if !versionFilePattern.MatchString(name) {
+			return strconv.Itoa(build), fmt.Errorf("Version file %s does not contain a valid version", p.versionFile)
+		}
+		return name, nil
+	}
+	return strconv.Itoa(build), nil
+}
+
+// The repository is untrusted, so the version file must be a regular file inside the checkout, not a symlink to
+// something readable elsewhere on the server.
+func readVersionFile(p *project) ([]byte, error) {
+	root, err := filepath.EvalSymlinks(fmt.Sprintf("%s/%d/workspace/source", projectAbs, p.id))
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(root, filepath.Clean("/"+p.versionFile))
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("Version file %s is not a regular file", p.versionFile)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+	if !within(root, resolved) {
+		return nil, fmt.Errorf("Version file %s is outside the repository", p.versionFile)
+	}
+	return ioutil.ReadFile(resolved)
+}
+
+func projectRecordVersion(p *project, trigger *taskTrigger) projectVersion {
+	name, err := projectNextVersion(p)
+	if err != nil {
+		logger.Errorf("Project %d version: %v", p.id, err)
+	}
+	p.version += 1
+	p.versionName = name
+	if p.versionBump != "" {
+		p.versionBump = ""
+		db.Exec(`UPDATE projects SET versionBump = '' WHERE id = ?`, p.id)
+	}
+	gitTag, err := expandTag(p.gitTagFormat, tagVariables(p, p.version, trigger))
+	if err != nil {
+		logger.Warnf("Project %d git tag: %v", p.id, err)
+	}
+	db.Exec(`INSERT OR REPLACE INTO versions(project, version, name, gitTag, commitHash, time) VALUES(?, ?, ?, ?, ?, datetime('now'))`,
+		p.id, p.version, name, gitTag, p.commit)
+	projectRecordSpecs(p, p.version)
+	return projectVersion{p.version, name, gitTag, p.commit}
+}
+
+func handleProjectBump(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/bump", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := findProject(id)
+	if p == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Project not found"))
+		return
+	}
+	switch params["part"] {
+	case "major", "minor", "patch", "":
+		p.versionBump = params["part"]
+	default:
+		w.WriteHeader(400)
+		w.Write([]byte("Invalid part"))
+		return
+	}
+	db.Exec(`UPDATE projects SET versionBump = ? WHERE id = ?`, p.versionBump, p.id)
+	projectUpdateEvent(p)
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
+
+func handleProjectVersions(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	p := findProject(id)
+	if p == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Project not found"))
+		return
+	}
+	specs := projectVersionSpecs(p)
+	result := make([]map[string]interface{}, 0)
+	rows, err := db.Query(`SELECT version, name, gitTag, commitHash, time FROM versions WHERE project = ? ORDER BY version DESC`, id)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var build int
+			var name, gitTag, commit, time string
+			rows.Scan(&build, &name, &gitTag, &commit, &time)
+			result = append(result, map[string]interface{}{
+				"version": build,
+				"name":    name,
+				"gitTag":  gitTag,
+				"commit":  commit,
+				"time":    time,
+				"specs":   specs[build],
+			})
+		}
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}